@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/yfauser/gocode/openflow"
 	"io"
 	"log"
 	"net"
@@ -171,42 +172,72 @@ func removsport(vethHost string) {
 	cmdexecutor(exec.Command("ovs-vsctl", "del-port", "br0", vethHost), true)
 }
 
-func createflows(vethid int, vethmac string, uplinkid int, uplinkmac string) {
-	Info.Printf("Add flows for POD in OpenFlow Table\n")
-	// add flow from POD to uplink in Table 2
-	cmdexecutor(exec.Command("ovs-ofctl", "add-flow", "br0",
-		"table=2, priority=100, in_port="+strconv.Itoa(vethid)+
-			", actions=mod_dl_src:"+uplinkmac+",output:"+strconv.Itoa(uplinkid)), true)
-	cmdexecutor(exec.Command("ovs-ofctl", "add-flow", "br0",
-		"table=2, priority=150, ip, arp, in_port="+strconv.Itoa(vethid)+
-			", actions=mod_dl_src:"+uplinkmac+", set_field:"+uplinkmac+"->arp_sha, output:"+strconv.Itoa(uplinkid)), true)
-	// add flow from uplink to POD in Table 3
-	cmdexecutor(exec.Command("ovs-ofctl", "add-flow", "br0",
-		"table=3, priority=100, in_port="+strconv.Itoa(uplinkid)+
-			", actions=mod_dl_dst:"+vethmac+",output:"+strconv.Itoa(vethid)), true)
-	cmdexecutor(exec.Command("ovs-ofctl", "add-flow", "br0",
-		"table=3, priority=150, ip, arp, in_port="+strconv.Itoa(uplinkid)+
-			", actions=mod_dl_dst:"+vethmac+", set_field:"+vethmac+"->arp_tha, output:"+strconv.Itoa(vethid)), true)
+func parsemac(mac string) net.HardwareAddr {
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		Error.Printf("could not parse MAC address %s\n", mac)
+	}
+	return hwaddr
+}
 
-	//ovs-ofctl add-flow br0 "table=2, priority=100, in_port=11 , ip, arp,actions=mod_dl_src:00:50:56:8a:2b:96,set_field:00:50:56:8a:2b:96->arp_sha,output:2"
+func ofexecutor(msgs ...openflow.Message) {
+	conn, err := openflow.Dial("br0")
+	if err != nil {
+		Error.Printf("could not open an OpenFlow connection to br0: %s\n", err)
+		return
+	}
+	defer conn.Close()
+	for _, msg := range msgs {
+		Info.Printf("Sending flow %s\n", msg)
+	}
+	if err := conn.Send(msgs...); err != nil {
+		Error.Printf("OpenFlow messages returned failure: %s\n", err)
+	}
+}
 
-	//ovs-ofctl add-flow br0 "table=3, priority=100, in_port=2 , ip, arp, actions=mod_dl_dst:02:42:c0:a8:6a:04, set_field:02:42:c0:a8:6a:04->arp_tha ,output:11"ß
+func createflows(vethid int, vethmac string, uplinkid int, uplinkmac string) {
+	Info.Printf("Add flows for POD in OpenFlow Table\n")
+	podmac := parsemac(vethmac)
+	hostmac := parsemac(uplinkmac)
+	ofexecutor(
+		// add flow from POD to uplink in Table 2
+		&openflow.FlowMod{Command: openflow.FlowAdd, Table: 2, Priority: 100,
+			Match: openflow.Match{openflow.InPort(uint32(vethid))},
+			Actions: []openflow.Action{&openflow.SetField{Field: openflow.EthSrc(hostmac)},
+				&openflow.Output{Port: uint32(uplinkid)}}},
+		&openflow.FlowMod{Command: openflow.FlowAdd, Table: 2, Priority: 150,
+			Match: openflow.Match{openflow.InPort(uint32(vethid)), openflow.EthType(openflow.EthTypeARP)},
+			Actions: []openflow.Action{&openflow.SetField{Field: openflow.EthSrc(hostmac)},
+				&openflow.SetField{Field: openflow.ArpSha(hostmac)}, &openflow.Output{Port: uint32(uplinkid)}}},
+		// add flow from uplink to POD in Table 3
+		&openflow.FlowMod{Command: openflow.FlowAdd, Table: 3, Priority: 100,
+			Match: openflow.Match{openflow.InPort(uint32(uplinkid))},
+			Actions: []openflow.Action{&openflow.SetField{Field: openflow.EthDst(podmac)},
+				&openflow.Output{Port: uint32(vethid)}}},
+		&openflow.FlowMod{Command: openflow.FlowAdd, Table: 3, Priority: 150,
+			Match: openflow.Match{openflow.InPort(uint32(uplinkid)), openflow.EthType(openflow.EthTypeARP)},
+			Actions: []openflow.Action{&openflow.SetField{Field: openflow.EthDst(podmac)},
+				&openflow.SetField{Field: openflow.ArpTha(podmac)}, &openflow.Output{Port: uint32(vethid)}}},
+	)
 }
 
 func deleteflows(vethid int, uplinkid int) {
 	Info.Printf("Delete flows for POD in OpenFlow Table\n")
-	// remove flow from OVS Table 2
-	cmdexecutor(exec.Command("ovs-ofctl", "del-flows", "br0", "table=2, in_port="+strconv.Itoa(vethid)), true)
-	// remove flow from OVS Table 3
-	cmdexecutor(exec.Command("ovs-ofctl", "del-flows", "br0", "table=3, in_port="+strconv.Itoa(uplinkid)), true)
+	ofexecutor(
+		// remove flow from OVS Table 2
+		&openflow.FlowMod{Command: openflow.FlowDelete, Table: 2, Match: openflow.Match{openflow.InPort(uint32(vethid))}},
+		// remove flow from OVS Table 3
+		&openflow.FlowMod{Command: openflow.FlowDelete, Table: 3, Match: openflow.Match{openflow.InPort(uint32(uplinkid))}},
+	)
 }
 
 func netinit() {
 	Info.Printf("Init called\n")
 	// Delete br0 on OVS in case it exists
 	cmdexecutor(exec.Command("ovs-vsctl", "del-br", "br0"), true)
-	// Add new br0 bridge to OVS
-	cmdexecutor(exec.Command("ovs-vsctl", "add-br", "br0", "--", "set", "Bridge", "br0", "fail-mode=secure"), true)
+	// Add new br0 bridge to OVS, OpenFlow 1.3 is needed for the flow programming and the service proxy
+	cmdexecutor(exec.Command("ovs-vsctl", "add-br", "br0", "--", "set", "Bridge", "br0", "fail-mode=secure",
+		"protocols=OpenFlow10,OpenFlow13"), true)
 	for i := 1; i < 10; i++ {
 		// Add all ethernet ports from 1 to 9 and change their state tp up
 		cmdexecutor(exec.Command("ovs-vsctl", "add-port", "br0", "eth"+strconv.Itoa(i), "--", "set",
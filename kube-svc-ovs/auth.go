@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	"k8s.io/kubernetes/pkg/client/unversioned/clientcmd"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// token of the service account of the pod, rotated by the kubelet
+	InClusterTokenFile string = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	// how long a token read from a file is used before the file is read again
+	TokenRefreshInterval = time.Minute
+)
+
+func apiConfig(cfg Config) (*restclient.Config, error) {
+	// the API server is reached through a kubeconfig, the service account of the pod
+	// or the master address with optional client certificates and token
+	var config *restclient.Config
+	tokenFile := cfg.TokenFile
+	switch {
+	case cfg.Kubeconfig != "":
+		loader := &clientcmd.ClientConfigLoadingRules{ExplicitPath: cfg.Kubeconfig}
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: cfg.Context}
+		var err error
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loader, overrides).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("could not load the kubeconfig %s: %s", cfg.Kubeconfig, err)
+		}
+	case cfg.InCluster:
+		var err error
+		config, err = restclient.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("could not load the in-cluster config: %s", err)
+		}
+		if tokenFile == "" {
+			tokenFile = InClusterTokenFile
+		}
+	default:
+		config = &restclient.Config{Host: cfg.Master}
+		config.CAFile = cfg.CAFile
+		config.CertFile = cfg.CertFile
+		config.KeyFile = cfg.KeyFile
+	}
+	if tokenFile != "" {
+		// the token is read by the transport, a rotated token is picked up without a restart
+		source := &tokenSource{path: tokenFile}
+		if _, err := source.get(); err != nil {
+			return nil, err
+		}
+		config.BearerToken = ""
+		wrap := config.WrapTransport
+		config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+			if wrap != nil {
+				rt = wrap(rt)
+			}
+			return &tokenRoundTripper{source: source, rt: rt}
+		}
+	}
+	return config, nil
+}
+
+// tokenSource caches the bearer token of a file for TokenRefreshInterval
+type tokenSource struct {
+	path    string
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (s *tokenSource) get() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Now().Before(s.expires) {
+		return s.token, nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if s.token != "" {
+			// keep using the last token, the file may be in the middle of a rotation
+			Error.Printf("could not refresh the token from %s: %s", s.path, err)
+			return s.token, nil
+		}
+		return "", fmt.Errorf("could not read the token %s: %s", s.path, err)
+	}
+	s.token = strings.TrimSpace(string(data))
+	s.expires = time.Now().Add(TokenRefreshInterval)
+	return s.token, nil
+}
+
+type tokenRoundTripper struct {
+	source *tokenSource
+	rt     http.RoundTripper
+}
+
+func (t *tokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.source.get()
+	if err != nil {
+		return nil, err
+	}
+	// round trippers must not modify the request they were given
+	authorized := new(http.Request)
+	*authorized = *req
+	authorized.Header = make(http.Header, len(req.Header))
+	for key, values := range req.Header {
+		authorized.Header[key] = values
+	}
+	authorized.Header.Set("Authorization", "Bearer "+token)
+	return t.rt.RoundTrip(authorized)
+}
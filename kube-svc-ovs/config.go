@@ -0,0 +1,284 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ghodss/yaml"
+	"github.com/yfauser/gocode/openflow"
+	"io/ioutil"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of kube-svc-ovs, read from a YAML file and
+// overridden by command line flags, which are the dashed keys of the file
+type Config struct {
+	// address of the API server, unused with a kubeconfig or in a cluster
+	Master string `json:"master"`
+	// kubeconfig and the context in it to use instead of its current context
+	Kubeconfig string `json:"kubeconfig"`
+	Context    string `json:"context"`
+	// use the service account of the pod
+	InCluster bool `json:"inCluster"`
+	// TLS client certificate and CA of the master
+	CAFile   string `json:"caFile"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// bearer token file, read again when it changes
+	TokenFile string `json:"tokenFile"`
+	// OVS bridge the services are programmed on
+	Bridge string `json:"bridge"`
+	// tables of the pipeline, the egress table is owned by the OVS plugin
+	ServiceTable     uint8 `json:"serviceTable"`
+	EgressTable      uint8 `json:"egressTable"`
+	AffinityTable    uint8 `json:"affinityTable"`
+	AffinityNatTable uint8 `json:"affinityNatTable"`
+	// group ids below are left to the OVS plugin
+	FirstGroup int    `json:"firstGroup"`
+	LogFile    string `json:"logFile"`
+	// bucket weights of topology aware services
+	SameZoneWeight  uint16 `json:"sameZoneWeight"`
+	OtherZoneWeight uint16 `json:"otherZoneWeight"`
+	// an empty address disables the metrics server or the debug API
+	MetricsAddress    string               `json:"metricsAddress"`
+	DebugSocket       string               `json:"debugSocket"`
+	ReconcileInterval unversioned.Duration `json:"reconcileInterval"`
+	// snapshot of the service groups for restarts, empty to disable
+	StateFile string `json:"stateFile"`
+	// dry-run outputs of the flows and the groups, - for stdout
+	DryRun       string `json:"dryRun"`
+	DryRunGroups string `json:"dryRunGroups"`
+	// remove everything the proxy programmed and exit, only a flag
+	Cleanup bool `json:"-"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Master:            "http://localhost:8080",
+		Bridge:            "br0",
+		ServiceTable:      1,
+		EgressTable:       2,
+		AffinityTable:     10,
+		AffinityNatTable:  11,
+		FirstGroup:        100,
+		LogFile:           "/tmp/watcher.log",
+		SameZoneWeight:    100,
+		OtherZoneWeight:   10,
+		MetricsAddress:    ":10249",
+		DebugSocket:       "/var/run/kube-svc-ovs.sock",
+		ReconcileInterval: unversioned.Duration{Duration: 60 * time.Second},
+		StateFile:         "/var/lib/kube-svc-ovs/state.json",
+	}
+}
+
+// uint8Value and uint16Value are flag values of the fixed size config fields
+type uint8Value struct{ p *uint8 }
+
+func (v uint8Value) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return fmt.Sprint(*v.p)
+}
+
+func (v uint8Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return err
+	}
+	*v.p = uint8(n)
+	return nil
+}
+
+type uint16Value struct{ p *uint16 }
+
+func (v uint16Value) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return fmt.Sprint(*v.p)
+}
+
+func (v uint16Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return err
+	}
+	*v.p = uint16(n)
+	return nil
+}
+
+func bindFlags(flags *flag.FlagSet, cfg *Config) *string {
+	// returns the path of the config file
+	path := flags.String("config", "", "YAML config file, flags override its values")
+	flags.StringVar(&cfg.Master, "master", cfg.Master, "address of the API server")
+	flags.StringVar(&cfg.Kubeconfig, "kubeconfig", cfg.Kubeconfig, "kubeconfig to connect to the API server with")
+	flags.StringVar(&cfg.Context, "context", cfg.Context, "context of the kubeconfig, its current context by default")
+	flags.BoolVar(&cfg.InCluster, "in-cluster", cfg.InCluster, "connect with the service account of the pod")
+	flags.StringVar(&cfg.CAFile, "ca-file", cfg.CAFile, "CA certificate of the master")
+	flags.StringVar(&cfg.CertFile, "cert-file", cfg.CertFile, "client certificate for the master")
+	flags.StringVar(&cfg.KeyFile, "key-file", cfg.KeyFile, "key of the client certificate")
+	flags.StringVar(&cfg.TokenFile, "token-file", cfg.TokenFile, "bearer token file, re-read periodically")
+	flags.StringVar(&cfg.Bridge, "bridge", cfg.Bridge, "OVS bridge the services are programmed on")
+	flags.Var(uint8Value{&cfg.ServiceTable}, "service-table", "OpenFlow table of the service flows")
+	flags.Var(uint8Value{&cfg.EgressTable}, "egress-table", "OpenFlow table of the OVS plugin the service flows continue in")
+	flags.Var(uint8Value{&cfg.AffinityTable}, "affinity-table", "OpenFlow table of the learned ClientIP affinity entries")
+	flags.Var(uint8Value{&cfg.AffinityNatTable}, "affinity-nat-table", "OpenFlow table of the ClientIP affinity DNAT flows")
+	flags.IntVar(&cfg.FirstGroup, "first-group", cfg.FirstGroup, "first OpenFlow group id used for services")
+	flags.StringVar(&cfg.LogFile, "log-file", cfg.LogFile, "log file, the log is written to stdout as well")
+	flags.Var(uint16Value{&cfg.SameZoneWeight}, "same-zone-weight", "bucket weight of endpoints in the zone of the node")
+	flags.Var(uint16Value{&cfg.OtherZoneWeight}, "other-zone-weight", "bucket weight of endpoints in other zones")
+	flags.StringVar(&cfg.MetricsAddress, "metrics-address", cfg.MetricsAddress, "address of the metrics server, empty to disable")
+	flags.StringVar(&cfg.DebugSocket, "debug-socket", cfg.DebugSocket, "unix socket of the debug API, empty to disable")
+	flags.DurationVar(&cfg.ReconcileInterval.Duration, "reconcile-interval", cfg.ReconcileInterval.Duration,
+		"how often the reconciler compares OVS with the services")
+	flags.StringVar(&cfg.StateFile, "state-file", cfg.StateFile, "snapshot of the service groups for restarts, empty to disable")
+	flags.BoolVar(&cfg.Cleanup, "cleanup", cfg.Cleanup, "remove all flows and groups of the proxy and exit")
+	flags.StringVar(&cfg.DryRun, "dry-run", cfg.DryRun,
+		"write the flows in ovs-ofctl add-flows syntax to this file, - for stdout, instead of programming OVS")
+	flags.StringVar(&cfg.DryRunGroups, "dry-run-groups", cfg.DryRunGroups,
+		"write the groups in ovs-ofctl add-groups syntax to this file, - for stdout, with dry-run")
+	return path
+}
+
+func loadConfig(name string, args []string) (Config, error) {
+	// defaults, then the config file, then the flags set on the command line
+	var scratch Config
+	scan := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := bindFlags(scan, &scratch)
+	if err := scan.Parse(args); err != nil {
+		return Config{}, err
+	}
+	cfg := defaultConfig()
+	if *path != "" {
+		if err := readConfigFile(*path, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	bindFlags(flags, &cfg)
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		// the API server used to be the only, positional, argument
+		cfg.Master = flags.Arg(0)
+	}
+	return cfg, cfg.validate()
+}
+
+func readConfigFile(path string, cfg *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read the config file: %s", err)
+	}
+	// a misspelled key would silently leave its default in place
+	var keys map[string]interface{}
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("config file %s: %s", path, err)
+	}
+	known := make(map[string]bool)
+	configType := reflect.TypeOf(*cfg)
+	for i := 0; i < configType.NumField(); i++ {
+		if key := configType.Field(i).Tag.Get("json"); key != "-" {
+			known[key] = true
+		}
+	}
+	var unknown []string
+	for key := range keys {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("config file %s: unknown keys %s", path, strings.Join(unknown, ", "))
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("config file %s: %s", path, err)
+	}
+	return nil
+}
+
+func (cfg Config) validate() error {
+	var errs []string
+	switch {
+	case cfg.Kubeconfig != "" && cfg.InCluster:
+		errs = append(errs, "kubeconfig and inCluster are exclusive")
+	case cfg.Kubeconfig != "" || cfg.InCluster:
+		if cfg.CAFile != "" || cfg.CertFile != "" || cfg.KeyFile != "" {
+			errs = append(errs, "caFile, certFile and keyFile are only used with master")
+		}
+	default:
+		if master, err := url.Parse(cfg.Master); err != nil || master.Scheme == "" || master.Host == "" {
+			errs = append(errs, fmt.Sprintf("master %q is not a URL like http://host:port", cfg.Master))
+		}
+	}
+	if cfg.Context != "" && cfg.Kubeconfig == "" {
+		errs = append(errs, "context needs a kubeconfig")
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		errs = append(errs, "certFile and keyFile have to be set together")
+	}
+	if cfg.Bridge == "" {
+		errs = append(errs, "bridge is empty")
+	}
+	// table 0 classifies the traffic of the OVS plugin
+	tables := map[string]uint8{"serviceTable": cfg.ServiceTable, "egressTable": cfg.EgressTable,
+		"affinityTable": cfg.AffinityTable, "affinityNatTable": cfg.AffinityNatTable}
+	names := []string{"serviceTable", "egressTable", "affinityTable", "affinityNatTable"}
+	for i, name := range names {
+		if tables[name] == 0 || tables[name] == openflow.TableAll {
+			errs = append(errs, fmt.Sprintf("%s %d is not between 1 and 254", name, tables[name]))
+		}
+		for _, other := range names[:i] {
+			if tables[name] == tables[other] {
+				errs = append(errs, fmt.Sprintf("%s and %s are both table %d", other, name, tables[name]))
+			}
+		}
+	}
+	if cfg.FirstGroup <= 0 || uint32(cfg.FirstGroup) >= openflow.GroupAll {
+		errs = append(errs, fmt.Sprintf("firstGroup %d is not a valid group id", cfg.FirstGroup))
+	}
+	if cfg.LogFile == "" {
+		errs = append(errs, "logFile is empty")
+	}
+	if cfg.SameZoneWeight == 0 || cfg.OtherZoneWeight == 0 {
+		errs = append(errs, "bucket weights must be at least 1, a bucket of weight 0 gets no traffic")
+	}
+	if cfg.Cleanup && cfg.DryRun != "" {
+		errs = append(errs, "cleanup and dryRun are exclusive")
+	}
+	if (cfg.DryRun == "") != (cfg.DryRunGroups == "") {
+		errs = append(errs, "dryRun and dryRunGroups go together, add-flows and add-groups read separate files")
+	} else if cfg.DryRun != "" && cfg.DryRun == cfg.DryRunGroups {
+		errs = append(errs, fmt.Sprintf("dryRun and dryRunGroups both write to %s", cfg.DryRun))
+	}
+	if cfg.ReconcileInterval.Duration <= 0 {
+		errs = append(errs, fmt.Sprintf("reconcileInterval %s is not positive", cfg.ReconcileInterval.Duration))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+func (cfg Config) apply() {
+	// the rest of the code reads the configuration from the package variables
+	Bridge = cfg.Bridge
+	ServiceTable = cfg.ServiceTable
+	EgressTable = cfg.EgressTable
+	AffinityTable = cfg.AffinityTable
+	AffinityNatTable = cfg.AffinityNatTable
+	FirstOvsGroup = cfg.FirstGroup
+	SameZoneWeight = cfg.SameZoneWeight
+	OtherZoneWeight = cfg.OtherZoneWeight
+	MetricsAddress = cfg.MetricsAddress
+	DebugSocket = cfg.DebugSocket
+	ReconcileInterval = cfg.ReconcileInterval.Duration
+	StateFile = cfg.StateFile
+	groupIds = newGroupAllocator()
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"github.com/yfauser/gocode/openflow"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/controller/framework"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/util/workqueue"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// full resync of the informer caches, every service gets synced again
+	InformerResync = 10 * time.Minute
+	// queue key of a reconciler run, '#' can't be part of a namespace/name key
+	ReconcileKey = "#reconcile"
+)
+
+// serviceController programs OVS from informer caches of Services and
+// Endpoints. Events of both are coalesced in a work queue by namespace/name
+// and handled one at a time by the sync loop, which owns the service state.
+type serviceController struct {
+	serviceStore        cache.Store
+	endpointsStore      cache.Store
+	podStore            cache.Store
+	nodeStore           cache.Store
+	serviceController   *framework.Controller
+	endpointsController *framework.Controller
+	podController       *framework.Controller
+	nodeController      *framework.Controller
+	queue               workqueue.RateLimitingInterface
+	services            []K8ssvc
+	// Services that aren't proxied by namespace/name, with the reason
+	skipped map[string]string
+	// closed on shutdown, stops the informers and the periodic reconcile
+	stop chan struct{}
+}
+
+func newServiceController(client *client.Client) *serviceController {
+	c := &serviceController{queue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		skipped: make(map[string]string), stop: make(chan struct{})}
+	c.serviceStore, c.serviceController = framework.NewInformer(
+		cache.NewListWatchFromClient(client, "services", api.NamespaceAll, fields.Everything()),
+		&api.Service{}, InformerResync, c.eventHandlers("services", true))
+	// Endpoints are the only source of backends. The Kubernetes 1.3 client this is built
+	// against has no discovery API group, so EndpointSlices (and their ready/serving/terminating
+	// conditions and topology hints) can't be watched until the client is upgraded. Only the
+	// ready Addresses are programmed, NotReadyAddresses never get a bucket.
+	c.endpointsStore, c.endpointsController = framework.NewInformer(
+		cache.NewListWatchFromClient(client, "endpoints", api.NamespaceAll, fields.Everything()),
+		&api.Endpoints{}, InformerResync, c.eventHandlers("endpoints", true))
+	// pods and nodes tell where endpoints run, changes are picked up with the next sync of the service
+	c.podStore, c.podController = framework.NewInformer(
+		cache.NewListWatchFromClient(client, "pods", api.NamespaceAll, fields.Everything()),
+		&api.Pod{}, InformerResync, c.eventHandlers("pods", false))
+	c.nodeStore, c.nodeController = framework.NewInformer(
+		cache.NewListWatchFromClient(client, "nodes", api.NamespaceAll, fields.Everything()),
+		&api.Node{}, InformerResync, c.eventHandlers("nodes", false))
+	return c
+}
+
+func (c *serviceController) eventHandlers(resource string, enqueue bool) framework.ResourceEventHandlerFuncs {
+	// all events are counted, only the ones of Services and Endpoints trigger a sync
+	handle := func(eventType string, obj interface{}) {
+		countEvent(resource, eventType)
+		if enqueue {
+			c.enqueue(obj)
+		}
+	}
+	return framework.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { handle("add", obj) },
+		UpdateFunc: func(old, cur interface{}) { handle("update", cur) },
+		DeleteFunc: func(obj interface{}) { handle("delete", obj) },
+	}
+}
+
+func (c *serviceController) enqueue(obj interface{}) {
+	// Services and their Endpoints share the key
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		Error.Printf("could not get the key of %+v: %s", obj, err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *serviceController) Run() {
+	// returns after SIGTERM or SIGINT, the flows stay in OVS and keep forwarding until the next start
+	go c.stopOnSignal()
+	if !dryRun() {
+		go c.exitOnDisconnect(ofconn)
+	}
+	go c.serviceController.Run(c.stop)
+	go c.endpointsController.Run(c.stop)
+	go c.podController.Run(c.stop)
+	go c.nodeController.Run(c.stop)
+	Info.Printf("Waiting for the Service, Endpoints, Pod and Node caches to sync")
+	err := wait.PollUntil(100*time.Millisecond, func() (bool, error) {
+		return c.serviceController.HasSynced() && c.endpointsController.HasSynced() &&
+			c.podController.HasSynced() && c.nodeController.HasSynced(), nil
+	}, c.stop)
+	if err != nil {
+		// stopped before the caches synced, nothing was programmed yet
+		Info.Printf("Stopped before the caches synced")
+		return
+	}
+	c.services = c.initialServices()
+	createInitialSvc(c.services)
+	c.publish()
+	saveState(c.services)
+
+	go wait.Until(func() { c.queue.Add(ReconcileKey) }, ReconcileInterval, c.stop)
+	go reconcileOnSignal(c.queue)
+	if DebugSocket != "" && !dryRun() {
+		// the socket may belong to the proxy programming this node
+		go serveDebug(DebugSocket, c.queue)
+	}
+	for c.processNextItem() {
+	}
+	saveState(c.services)
+	Info.Printf("Stopped, the programmed services keep forwarding")
+}
+
+func (c *serviceController) stopOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	Info.Printf("%s received, stopping after the current sync", sig)
+	close(c.stop)
+	c.queue.ShutDown()
+}
+
+func (c *serviceController) exitOnDisconnect(conn *openflow.Conn) {
+	// nothing could be programmed without the connection, the restart adopts the
+	// flows left in OVS and the reconciler repairs them if OVS was restarted
+	select {
+	case <-conn.Done():
+		Error.Printf("Lost the OpenFlow connection to %s, exiting: %s", Bridge, conn.Err())
+		os.Exit(1)
+	case <-c.stop:
+	}
+}
+
+func (c *serviceController) initialServices() []K8ssvc {
+	// the services of the synced cache, programmed in one go at startup
+	services := []K8ssvc{}
+	for _, obj := range c.serviceStore.List() {
+		svcObject := obj.(*api.Service)
+		if reason := skipReason(svcObject); reason != "" {
+			c.skip(serviceKey(svcObject.Namespace, svcObject.Name), reason)
+			continue
+		}
+		svcToAdd := constructService(svcObject, c.getEndpoints(serviceKey(svcObject.Namespace, svcObject.Name)))
+		svcToAdd.Topology = c.endpointTopology(svcToAdd.Endpoints)
+		assignGroups(&svcToAdd, nil)
+		if checkLength(serviceMessages(svcToAdd)) == openflow.ErrTooLong {
+			Error.Printf("Service %s has too many endpoints for an OpenFlow group, not programming it",
+				serviceKey(svcToAdd.Namespace, svcToAdd.Name))
+			c.skipped[serviceKey(svcToAdd.Namespace, svcToAdd.Name)] = SkipTooLong
+			releaseGroups(serviceGroups(svcToAdd))
+			continue
+		}
+		addServiceToArray(-1, &svcToAdd, &services)
+	}
+	return services
+}
+
+func (c *serviceController) getEndpoints(key string) *api.Endpoints {
+	obj, exists, err := c.endpointsStore.GetByKey(key)
+	if err != nil || !exists {
+		return nil
+	}
+	return obj.(*api.Endpoints)
+}
+
+func (c *serviceController) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+	var err error
+	start := time.Now()
+	switch {
+	case key.(string) == ReconcileKey:
+		err = runReconcile(c.services)
+		syncDuration.WithLabelValues("reconcile", syncResult(err)).Observe(time.Since(start).Seconds())
+		saveState(c.services)
+	case strings.HasPrefix(key.(string), ResyncKeyPrefix):
+		err = c.resyncService(strings.TrimPrefix(key.(string), ResyncKeyPrefix))
+		syncDuration.WithLabelValues("resync", syncResult(err)).Observe(time.Since(start).Seconds())
+		c.publish()
+	default:
+		err = c.syncService(key.(string))
+		syncDuration.WithLabelValues("service", syncResult(err)).Observe(time.Since(start).Seconds())
+		c.publish()
+	}
+	if err != nil {
+		Error.Printf("Syncing %s failed, retrying: %s", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *serviceController) publish() {
+	// hands the services to the metrics and the debug API, which run outside of the sync loop
+	updateServiceMetrics(c.services, c.skipped)
+	debugState.setServices(c.services, c.skipped)
+}
+
+func (c *serviceController) skip(key string, reason string) {
+	if c.skipped[key] != reason {
+		Info.Printf("Not proxying Service %s: %s", key, reason)
+		c.skipped[key] = reason
+	}
+}
+
+func (c *serviceController) resyncService(key string) error {
+	// a forced resync reprograms the service even if its state didn't change
+	if err := c.syncService(key); err != nil {
+		return err
+	}
+	index := findServiceByKey(c.services, key)
+	if index < 0 {
+		return nil
+	}
+	Info.Printf("Reprogramming Service %s", key)
+	return resyncSvcOvs(c.services[index])
+}
+
+func (c *serviceController) syncService(key string) error {
+	// brings OVS in line with the cached state of the Service and Endpoints with this key
+	index := findServiceByKey(c.services, key)
+	obj, exists, err := c.serviceStore.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		delete(c.skipped, key)
+		if index >= 0 {
+			return delSvc(index, &c.services)
+		}
+		return nil
+	}
+	if reason := skipReason(obj.(*api.Service)); reason != "" {
+		c.skip(key, reason)
+		if index >= 0 {
+			// the type changed, e.g. to ExternalName, the flows of the cluster IP go
+			Info.Printf("Service %s can no longer be proxied, removing it", key)
+			return delSvc(index, &c.services)
+		}
+		return nil
+	}
+	service := constructService(obj.(*api.Service), c.getEndpoints(key))
+	service.Topology = c.endpointTopology(service.Endpoints)
+	if index >= 0 && c.services[index].Uid != service.Uid {
+		// the Service was re-created under the same name, it gets fresh groups
+		Info.Printf("Service %s was re-created", key)
+		if err := delSvc(index, &c.services); err != nil {
+			return err
+		}
+		index = -1
+	}
+	if index < 0 {
+		err = addSvc(service, &c.services)
+	} else {
+		err = modSvc(index, service, &c.services)
+	}
+	if err == openflow.ErrTooLong {
+		// the groups don't fit in a message, the next change of the endpoints tries again
+		c.skipped[key] = SkipTooLong
+		return nil
+	}
+	if _, ok := c.skipped[key]; ok && err == nil {
+		Info.Printf("Service %s can be proxied now", key)
+		delete(c.skipped, key)
+	}
+	return err
+}
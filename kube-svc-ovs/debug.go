@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"k8s.io/kubernetes/pkg/util/workqueue"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// queue key prefix of a forced resync of the service with the namespace/name key
+const ResyncKeyPrefix string = "#resync/"
+
+// the debug API can force resyncs, it is only reachable through a local socket set from the Config
+var DebugSocket string
+
+// debugService is a service as served by the debug API, with the buckets of its groups
+type debugService struct {
+	K8ssvc
+	Groups []debugGroup
+}
+
+type debugGroup struct {
+	PortGroup string
+	GroupID   int
+	Buckets   []debugBucket
+}
+
+type debugBucket struct {
+	IP     string
+	Port   int32
+	Weight uint16
+}
+
+// debugAPI serves a copy of the services published by the sync loop after
+// every change, the handlers never touch the state of the sync loop itself.
+type debugAPI struct {
+	mu       sync.Mutex
+	services []K8ssvc
+	skipped  map[string]string
+	queue    workqueue.Interface
+}
+
+var debugState = &debugAPI{}
+
+func (d *debugAPI) setServices(services []K8ssvc, skipped map[string]string) {
+	// the slice is copied, the maps and slices of a service are replaced on change and never modified
+	snapshot := make([]K8ssvc, len(services))
+	copy(snapshot, services)
+	skippedCopy := make(map[string]string, len(skipped))
+	for key, reason := range skipped {
+		skippedCopy[key] = reason
+	}
+	d.mu.Lock()
+	d.services = snapshot
+	d.skipped = skippedCopy
+	d.mu.Unlock()
+}
+
+func (d *debugAPI) getServices() []K8ssvc {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.services
+}
+
+func describeService(service K8ssvc) debugService {
+	described := debugService{K8ssvc: service}
+	for _, pg := range portGroups(service) {
+		group := debugGroup{PortGroup: pg.name(), GroupID: service.OvsGroups[pg.name()]}
+		for _, ep := range portEndpoints(service, pg) {
+			group.Buckets = append(group.Buckets, debugBucket{IP: ep.IP, Port: ep.Port, Weight: bucketWeight(service, ep)})
+		}
+		described.Groups = append(described.Groups, group)
+	}
+	return described
+}
+
+func (d *debugAPI) serveServices(w http.ResponseWriter, r *http.Request) {
+	// all services including the deleted ones, their slots get reused
+	var described []debugService
+	for _, service := range d.getServices() {
+		described = append(described, describeService(service))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(described); err != nil {
+		Error.Printf("Debug API: could not encode the services: %s", err)
+	}
+}
+
+func (d *debugAPI) serveSkipped(w http.ResponseWriter, r *http.Request) {
+	// the Services that aren't proxied by namespace/name, with the reason
+	d.mu.Lock()
+	skipped := d.skipped
+	d.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(skipped); err != nil {
+		Error.Printf("Debug API: could not encode the skipped services: %s", err)
+	}
+}
+
+func (d *debugAPI) serveService(w http.ResponseWriter, r *http.Request) {
+	// /debug/services/<namespace>/<name>/flows shows the programmed messages,
+	// a POST to /debug/services/<namespace>/<name>/resync reprograms the service
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/debug/services/"), "/")
+	if len(parts) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	key := serviceKey(parts[0], parts[1])
+	services := d.getServices()
+	index := findServiceByKey(services, key)
+	switch {
+	case parts[2] == "flows" && r.Method == "GET":
+		if index < 0 {
+			http.Error(w, "no service "+key, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		for _, msg := range serviceMessages(services[index]) {
+			fmt.Fprintf(w, "%s %s\n", ofCommandName(msg), msg)
+		}
+	case parts[2] == "resync" && r.Method == "POST":
+		Info.Printf("Debug API: resync of Service %s requested", key)
+		d.queue.Add(ResyncKeyPrefix + key)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "resync of %s queued\n", key)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func serveDebug(path string, queue workqueue.Interface) {
+	debugState.queue = queue
+	// a socket left behind by the last run would fail the listen
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		Error.Printf("Could not open the debug socket %s: %s", path, err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/services", debugState.serveServices)
+	mux.HandleFunc("/debug/services/", debugState.serveService)
+	mux.HandleFunc("/debug/skipped", debugState.serveSkipped)
+	Info.Printf("Serving the debug API on %s", path)
+	if err := http.Serve(listener, mux); err != nil {
+		Error.Printf("Debug API stopped: %s", err)
+	}
+}
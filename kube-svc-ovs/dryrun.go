@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"github.com/yfauser/gocode/openflow"
+	"io"
+	"os"
+)
+
+// In dry-run mode OVS is never connected, the messages are written in the order
+// they would be sent, the flow-mods to dryRunFlows in ovs-ofctl add-flows syntax and
+// the group-mods to dryRunGroups in add-groups syntax. The flows point to the groups,
+// the groups file is applied first.
+var dryRunFlows, dryRunGroups io.Writer
+
+func dryRun() bool {
+	return dryRunFlows != nil
+}
+
+func openDryRun(path string) *os.File {
+	// "-" writes to stdout
+	if path == "-" {
+		return os.Stdout
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		Error.Fatalf("could not open the dry-run output %s: %s", path, err)
+	}
+	return file
+}
+
+func writeDryRun(msgs []openflow.Message) error {
+	for _, msg := range msgs {
+		output := dryRunFlows
+		if _, ok := msg.(*openflow.GroupMod); ok {
+			output = dryRunGroups
+		}
+		if _, err := fmt.Fprintln(output, openflow.OfctlLine(msg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/yfauser/gocode/openflow"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// group ids below are left to other users of the bridge, set from the Config
+var FirstOvsGroup int
+
+// groupAllocator hands out the OVS group ids of services. Released ids go to a
+// free list and are reused lowest first, so an id is never handed out twice
+// while its group is still programmed.
+type groupAllocator struct {
+	next int
+	free []int
+	used map[int]bool
+	// groups found in OVS at startup, keyed by the cluster IP and port pointing to them
+	// or by the snapshot key of the service group
+	recovered map[string]int
+	existing  map[int]bool
+}
+
+func newGroupAllocator() *groupAllocator {
+	return &groupAllocator{
+		next:      FirstOvsGroup,
+		used:      make(map[int]bool),
+		recovered: make(map[string]int),
+		existing:  make(map[int]bool),
+	}
+}
+
+func groupKey(clusterIP string, proto uint8, port int32) string {
+	// a service port as seen in the match of its cluster IP flow
+	return clusterIP + "/" + strconv.Itoa(int(proto)) + "/" + strconv.Itoa(int(port))
+}
+
+func flowGroup(flow *openflow.FlowStats) (int, bool) {
+	// the group a service flow points to, services with affinity carry it in reg4
+	for _, action := range flow.Actions {
+		switch a := action.(type) {
+		case *openflow.Group:
+			return int(a.GroupID), true
+		case *openflow.SetField:
+			if a.Field.Field == openflow.FieldReg(4) && len(a.Field.Value) == 4 {
+				return int(binary.BigEndian.Uint32(a.Field.Value)), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (a *groupAllocator) recover(conn *openflow.Conn) error {
+	// rebuilds the allocator from the groups and service flows programmed in OVS,
+	// so services keep their group id across restarts
+	groups, err := conn.DumpGroups()
+	if err != nil {
+		return err
+	}
+	flows, err := conn.DumpFlows(ServiceTable, 0, 0)
+	if err != nil {
+		return err
+	}
+	a.recoverFrom(groups, flows)
+	return nil
+}
+
+func (a *groupAllocator) recoverFrom(groups []*openflow.GroupDesc, flows []*openflow.FlowStats) {
+	for _, group := range groups {
+		if int(group.GroupID) >= FirstOvsGroup {
+			a.existing[int(group.GroupID)] = true
+		}
+	}
+	for _, flow := range flows {
+		var clusterIP string
+		var proto uint8
+		var port int32
+		nodePort := false
+		for _, field := range flow.Match {
+			switch field.Field {
+			case openflow.FieldIPv4Dst, openflow.FieldIPv6Dst:
+				clusterIP = net.IP(field.Value).String()
+			case openflow.FieldIPProto:
+				proto = field.Value[0]
+			case openflow.FieldTCPDst, openflow.FieldUDPDst, openflow.FieldSCTPDst:
+				port = int32(binary.BigEndian.Uint16(field.Value))
+			case openflow.FieldCtState:
+				// NodePort flows match on node addresses shared by all services
+				nodePort = true
+			}
+		}
+		id, ok := flowGroup(flow)
+		if clusterIP == "" || nodePort || !ok || !a.existing[id] {
+			continue
+		}
+		a.recovered[groupKey(clusterIP, proto, port)] = id
+	}
+	for id := range a.existing {
+		if id >= a.next {
+			a.next = id + 1
+		}
+	}
+	for id := FirstOvsGroup; id < a.next; id++ {
+		// the groups still in OVS stay reserved until a service claims them or stale deletes them
+		if !a.existing[id] {
+			a.free = append(a.free, id)
+		}
+	}
+	Info.Printf("Recovered %d groups and %d service group ids from OVS", len(a.existing), len(a.recovered))
+}
+
+func (a *groupAllocator) allocate(keys ...string) int {
+	// prefers the id the service port had before the restart, the first key found wins
+	for _, key := range keys {
+		if id, ok := a.recovered[key]; ok && !a.used[id] {
+			delete(a.recovered, key)
+			a.take(id)
+			return id
+		}
+	}
+	if len(a.free) > 0 {
+		id := a.free[0]
+		a.free = a.free[1:]
+		a.used[id] = true
+		return id
+	}
+	id := a.next
+	a.next++
+	a.used[id] = true
+	return id
+}
+
+func (a *groupAllocator) take(id int) {
+	for index, freeID := range a.free {
+		if freeID == id {
+			a.free = append(a.free[:index], a.free[index+1:]...)
+			break
+		}
+	}
+	a.used[id] = true
+}
+
+func (a *groupAllocator) exists(id int) bool {
+	// whether the group was already programmed in OVS at startup
+	return a.existing[id]
+}
+
+func (a *groupAllocator) release(id int) {
+	if !a.used[id] {
+		return
+	}
+	delete(a.used, id)
+	if a.existing[id] {
+		// the group of the last run is still programmed, stale deletes it
+		return
+	}
+	a.free = append(a.free, id)
+	sort.Ints(a.free)
+}
+
+func (a *groupAllocator) stale() []int {
+	// groups found in OVS that no service claimed, to be deleted after the initial sync.
+	// Their ids become free for new services.
+	var ids []int
+	for id := range a.existing {
+		if !a.used[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	a.free = append(a.free, ids...)
+	sort.Ints(a.free)
+	// the claimed groups are owned by their services from now on
+	a.existing = make(map[int]bool)
+	a.recovered = make(map[string]int)
+	return ids
+}
+
+func assignGroups(service *K8ssvc, current map[string]int) {
+	// groups are kept by the current service with the same name, new ones are allocated.
+	// After a restart the groups come back from the snapshot, without one only the
+	// groups of the cluster IP flows can be recovered.
+	service.OvsGroups = make(map[string]int)
+	for _, pg := range portGroups(*service) {
+		if group, ok := current[pg.name()]; ok {
+			service.OvsGroups[pg.name()] = group
+			continue
+		}
+		keys := []string{snapshotKey(service.Uid, pg.name())}
+		for _, clusterIP := range service.ClusterIPs {
+			if pg.Local == service.InternalLocal && isIPv6(clusterIP) == pg.IPv6 {
+				keys = append(keys, groupKey(clusterIP, ipProto(pg.Port.Protocol), pg.Port.Port))
+			}
+		}
+		service.OvsGroups[pg.name()] = groupIds.allocate(keys...)
+	}
+}
+
+func serviceGroups(service K8ssvc) []int {
+	// group ids in port order
+	var groups []int
+	for _, pg := range portGroups(service) {
+		if group, ok := service.OvsGroups[pg.name()]; ok {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func groupsNotIn(service K8ssvc, other map[string]int) []int {
+	// groups of the service that the other service doesn't have
+	var groups []int
+	for _, pg := range portGroups(service) {
+		if _, ok := other[pg.name()]; !ok {
+			groups = append(groups, service.OvsGroups[pg.name()])
+		}
+	}
+	return groups
+}
+
+func releaseGroups(groups []int) {
+	for _, group := range groups {
+		groupIds.release(group)
+	}
+}
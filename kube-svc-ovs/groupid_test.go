@@ -0,0 +1,178 @@
+package main
+
+import (
+	"github.com/yfauser/gocode/openflow"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// allocStep is one call on the allocator, allocate wants id, release gives id back
+// and stale wants the ids of stale
+type allocStep struct {
+	op    string
+	keys  []string
+	id    int
+	stale []int
+}
+
+// clusterFlow is the service flow of a cluster IP and TCP port pointing to group
+func clusterFlow(clusterIP string, port uint16, group uint32) *openflow.FlowStats {
+	ip := net.ParseIP(clusterIP)
+	return &openflow.FlowStats{Table: ServiceTable,
+		Match: openflow.Match{openflow.EthType(ipEthType(clusterIP)), openflow.IPDst(ip), openflow.IPProto(openflow.IPProtoTCP),
+			openflow.L4Dst(openflow.IPProtoTCP, port)},
+		Actions: []openflow.Action{&openflow.Group{GroupID: group}}}
+}
+
+// nodePortFlow is a NodePort flow, it matches on a node address and on ct_state
+func nodePortFlow(nodeIP string, port uint16, group uint32) *openflow.FlowStats {
+	flow := clusterFlow(nodeIP, port, group)
+	flow.Match = append(flow.Match, openflow.CtState(0x20, 0x20))
+	return flow
+}
+
+func existingGroups(ids ...uint32) []*openflow.GroupDesc {
+	var groups []*openflow.GroupDesc
+	for _, id := range ids {
+		groups = append(groups, &openflow.GroupDesc{Type: openflow.GroupTypeSelect, GroupID: id})
+	}
+	return groups
+}
+
+var (
+	// the keys the first port of services a and b allocate with after a restart
+	keyA = []string{snapshotKey("uid-a", "http"), groupKey("10.96.0.10", openflow.IPProtoTCP, 80)}
+	keyB = []string{snapshotKey("uid-b", "http"), groupKey("10.96.0.11", openflow.IPProtoTCP, 80)}
+	// a service that wasn't there before the restart
+	keyNew = []string{snapshotKey("uid-new", "http"), groupKey("10.96.0.99", openflow.IPProtoTCP, 80)}
+)
+
+func TestGroupAllocator(t *testing.T) {
+	Info = log.New(ioutil.Discard, "", 0)
+	FirstOvsGroup = 100
+	for _, test := range []struct {
+		name     string
+		groups   []*openflow.GroupDesc
+		flows    []*openflow.FlowStats
+		snapshot []serviceSnapshot
+		steps    []allocStep
+	}{
+		{
+			name: "fresh start",
+			steps: []allocStep{
+				{op: "allocate", keys: keyA, id: 100},
+				{op: "allocate", keys: keyB, id: 101},
+				{op: "stale"},
+				{op: "release", id: 100},
+				{op: "allocate", keys: keyNew, id: 100},
+				{op: "allocate", keys: keyNew, id: 102},
+			},
+		},
+		{
+			// a gets its group back from the snapshot, b from its cluster IP flow,
+			// the gaps and the unclaimed groups are handed out to new services
+			name:     "restart with existing and snapshot ids",
+			groups:   existingGroups(100, 101, 103),
+			flows:    []*openflow.FlowStats{clusterFlow("10.96.0.11", 80, 101), nodePortFlow("192.168.0.1", 80, 100)},
+			snapshot: []serviceSnapshot{{Uid: "uid-a", Groups: map[string]int{"http": 103}}},
+			steps: []allocStep{
+				{op: "allocate", keys: keyA, id: 103},
+				{op: "allocate", keys: keyB, id: 101},
+				{op: "allocate", keys: keyNew, id: 102},
+				{op: "allocate", keys: keyNew, id: 104},
+				{op: "stale", stale: []int{100}},
+				{op: "allocate", keys: keyNew, id: 100},
+			},
+		},
+		{
+			// the snapshot and the flows point to groups that are gone from OVS
+			name:     "restart with deleted groups",
+			groups:   existingGroups(101),
+			flows:    []*openflow.FlowStats{clusterFlow("10.96.0.10", 80, 100)},
+			snapshot: []serviceSnapshot{{Uid: "uid-b", Groups: map[string]int{"http": 102}}},
+			steps: []allocStep{
+				{op: "allocate", keys: keyA, id: 100},
+				{op: "allocate", keys: keyB, id: 102},
+				{op: "stale", stale: []int{101}},
+				{op: "allocate", keys: keyNew, id: 101},
+			},
+		},
+		{
+			// the group of a is still programmed until stale, its id isn't free before
+			name:   "release of a recovered id before stale",
+			groups: existingGroups(100, 101),
+			flows:  []*openflow.FlowStats{clusterFlow("10.96.0.10", 80, 100)},
+			steps: []allocStep{
+				{op: "allocate", keys: keyA, id: 100},
+				{op: "release", id: 100},
+				{op: "allocate", keys: keyNew, id: 102},
+				{op: "stale", stale: []int{100, 101}},
+				{op: "allocate", keys: keyNew, id: 100},
+				{op: "allocate", keys: keyNew, id: 101},
+				{op: "allocate", keys: keyNew, id: 103},
+			},
+		},
+		{
+			name:   "free-list reuse after stale",
+			groups: existingGroups(100, 101, 102),
+			steps: []allocStep{
+				{op: "stale", stale: []int{100, 101, 102}},
+				{op: "allocate", keys: keyA, id: 100},
+				{op: "allocate", keys: keyB, id: 101},
+				{op: "release", id: 100},
+				{op: "allocate", keys: keyNew, id: 100},
+				{op: "allocate", keys: keyNew, id: 102},
+				{op: "allocate", keys: keyNew, id: 103},
+				{op: "release", id: 102},
+				{op: "release", id: 101},
+				{op: "allocate", keys: keyNew, id: 101},
+			},
+		},
+		{
+			// the snapshot of a and the cluster IP flow of b claim the same group
+			name:     "no id handed out twice",
+			groups:   existingGroups(100),
+			flows:    []*openflow.FlowStats{clusterFlow("10.96.0.11", 80, 100)},
+			snapshot: []serviceSnapshot{{Uid: "uid-a", Groups: map[string]int{"http": 100}}},
+			steps: []allocStep{
+				{op: "allocate", keys: keyA, id: 100},
+				{op: "allocate", keys: keyB, id: 101},
+				{op: "release", id: 100},
+				{op: "release", id: 100},
+				{op: "stale", stale: []int{100}},
+				{op: "allocate", keys: keyNew, id: 100},
+				{op: "allocate", keys: keyNew, id: 102},
+			},
+		},
+	} {
+		a := newGroupAllocator()
+		if test.groups != nil {
+			a.recoverFrom(test.groups, test.flows)
+			a.restore(&stateSnapshot{Services: test.snapshot})
+		}
+		held := make(map[int]bool)
+		for i, step := range test.steps {
+			switch step.op {
+			case "allocate":
+				id := a.allocate(step.keys...)
+				if held[id] {
+					t.Errorf("%s: step %d handed out %d twice", test.name, i, id)
+				}
+				held[id] = true
+				if id != step.id {
+					t.Errorf("%s: step %d allocated %d, want %d", test.name, i, id, step.id)
+				}
+			case "release":
+				a.release(step.id)
+				delete(held, step.id)
+			case "stale":
+				if ids := a.stale(); !reflect.DeepEqual(ids, step.stale) {
+					t.Errorf("%s: step %d found stale groups %v, want %v", test.name, i, ids, step.stale)
+				}
+			}
+		}
+	}
+}
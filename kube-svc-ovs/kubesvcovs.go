@@ -1,59 +1,83 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/yfauser/gocode/openflow"
 	"io"
 	"k8s.io/kubernetes/pkg/api"
-	"k8s.io/kubernetes/pkg/client/restclient"
 	client "k8s.io/kubernetes/pkg/client/unversioned"
-	"k8s.io/kubernetes/pkg/fields"
-	"k8s.io/kubernetes/pkg/labels"
-	"k8s.io/kubernetes/pkg/runtime"
 	"k8s.io/kubernetes/pkg/types"
 	"log"
+	"net"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 var (
-	Host    string = "http://10.114.209.77:8080"
-	listopt        = api.ListOptions{LabelSelector: labels.Everything(), FieldSelector: fields.Everything()}
-	Info    *log.Logger
-	Error   *log.Logger
+	Info  *log.Logger
+	Error *log.Logger
 )
 
-var mutex = &sync.Mutex{}
+// set from the Config at startup
+var (
+	Bridge string
+	// tables of the OVS pipeline, the egress table is owned by the OVS plugin
+	ServiceTable uint8
+	EgressTable  uint8
+	// learned ClientIP affinity entries and the per endpoint DNAT flows they lead to
+	AffinityTable    uint8
+	AffinityNatTable uint8
+	// how often the reconciler compares OVS with the services
+	ReconcileInterval time.Duration
+)
 
-type K8ssvc struct {
-	Name         string
-	Namespace    string
-	Uid          types.UID
-	ClusterIP    string
-	Ports        []api.ServicePort
-	Endpoints    []api.EndpointSubset
-	EndpointsUid types.UID
-	OvsGroup     int
-	Deleted      bool
-}
+const (
+	NodePortSnatZone uint16 = 2
+	// annotation overriding the ClientIP affinity timeout, the API has no field for it
+	AffinityTimeoutAnnotation string = "kube-svc-ovs/client-ip-timeout-seconds"
+	// annotation standing in for spec.clusterIPs of dual-stack Services, which the 1.3 API lacks.
+	// A comma separated list with at most one address per family, the families follow from it.
+	ClusterIPsAnnotation string = "kube-svc-ovs/cluster-ips"
+	// same default as kube-proxy, OVS timeouts are limited to 16 bits
+	DefaultAffinityTimeout int = 10800
+	MaxAffinityTimeout     int = 65535
+	// cookie of all flows programmed by the proxy
+	ProxyCookie uint64 = 0x4b535643
+)
 
-func formatK8svcJson(in *api.Service) string {
-	jsonsvcs, err := json.MarshalIndent(in, "", "     ")
-	if err != nil {
-		Error.Printf("Could not parse Object and return JSON", err)
-	}
-	return string(jsonsvcs)
-}
+// OpenFlow connection to the bridge all flows and groups are programmed on
+var ofconn *openflow.Conn
 
-func formatK8endpointJson(in *api.Endpoints) string {
-	jsonsvcs, err := json.MarshalIndent(in, "", "     ")
-	if err != nil {
-		Error.Printf("Could not parse Object and return JSON", err)
-	}
-	return string(jsonsvcs)
+// local addresses of the node NodePort services are reachable on
+var NodeIPs []string
+
+// group ids of the services, only used by the sync loop
+var groupIds = newGroupAllocator()
+
+type K8ssvc struct {
+	Name            string
+	Namespace       string
+	Uid             types.UID
+	ClusterIP       string
+	ClusterIPs      []string
+	ExternalIPs     []string
+	IngressIPs      []string
+	Ports           []api.ServicePort
+	SessionAffinity api.ServiceAffinity
+	AffinityTimeout int
+	Endpoints       []api.EndpointSubset
+	EndpointsUid    types.UID
+	// OVS group of every service port, keyed by the port group name
+	OvsGroups map[string]int
+	// traffic policies and where the endpoints run, keyed by IP
+	ExternalLocal bool
+	InternalLocal bool
+	TopologyAware bool
+	Topology      map[string]endpointTopology
+	Deleted       bool
 }
 
 func openlog(filename string) *os.File {
@@ -64,158 +88,212 @@ func openlog(filename string) *os.File {
 	return file
 }
 
-func createapiclient(config *restclient.Config) *client.Client {
-	client, err := client.New(config)
+func createapiclient(cfg Config) *client.Client {
+	config, err := apiConfig(cfg)
 	if err != nil {
-		Error.Printf("Error connecting to the K8s API")
+		Error.Fatalf("Error configuring the K8s API client: %s", err)
 	}
-	return client
-}
-
-func cmdexecutor(cmd *exec.Cmd, quite bool) string {
-	Info.Printf("Executing command %s\n", strings.Join(cmd.Args, " "))
-	output, err := cmd.CombinedOutput()
+	apiClient, err := client.New(config)
 	if err != nil {
-		Error.Printf("command %s returned failure and following stdout: %s\n", strings.Join(cmd.Args, " "), output)
-		return string(output)
-	}
-	if len(output) > 0 && quite {
-		Info.Printf("Command '%s' returned: %s\n", strings.Join(cmd.Args, " "), output)
+		Error.Fatalf("Error connecting to the K8s API: %s", err)
 	}
-	return string(output)
+	return apiClient
 }
 
-func constructCtEntries(service K8ssvc, subset api.EndpointSubset) (ct string) {
-	var entry string = ""
-	CtPrefix := "group_id=" + strconv.Itoa(service.OvsGroup) + ",type=select,"
-	if len(subset.Addresses) == 0 {
-		ct = CtPrefix
-		return ct
-	}
-	for _, port := range subset.Ports {
-		portString := ":" + strconv.Itoa(int(port.Port))
-		for _, ip := range subset.Addresses {
-			entryPrefix := "bucket=weight=100,ct(nat(dst="
-			entry = entry + entryPrefix + ip.IP + portString + "),commit,table=2),"
+func createInitialSvc(services []K8ssvc) {
+	// Create all services that were retrieved on Init. The flows and groups a previous run left
+	// in OVS are adopted, only the differences are corrected and traffic keeps flowing.
+	Info.Printf("Creating initial set of services in OVS")
+	if !dryRun() {
+		err := runReconcile(services)
+		if err == nil {
+			// the reconciler deleted the groups no service claimed, their ids become free
+			groupIds.stale()
+			return
 		}
+		Error.Printf("Failed to adopt the flows in OVS, replacing them: %s", err)
 	}
-
-	ct = CtPrefix + entry[:len(entry)-1]
-	return ct
-}
-
-func addOvsSvc(service K8ssvc) {
-	if len(service.Endpoints) == 0 {
-		var subset api.EndpointSubset
-		ctString := constructCtEntries(service, subset)
-		cmdexecutor(exec.Command("ovs-ofctl", "-O", "OpenFlow13", "add-group", "br0", ctString), true)
-		cmdexecutor(exec.Command("ovs-ofctl", "-O", "OpenFlow13", "add-flow", "br0",
-			"table=1,priority=100,ip,nw_dst="+service.ClusterIP+",actions=group:"+strconv.Itoa(int(service.OvsGroup))), true)
-	} else {
-		for _, subset := range service.Endpoints {
-			ctString := constructCtEntries(service, subset)
-			cmdexecutor(exec.Command("ovs-ofctl", "-O", "OpenFlow13", "add-group", "br0", ctString), true)
-			for _, port := range service.Ports {
-				var protocol string
-				if port.Protocol == "TCP" {
-					protocol = ",ip_proto=6,tcp_dst=" + strconv.Itoa(int(port.Port))
-				}
-				if port.Protocol == "UDP" {
-					protocol = ",ip_proto=17,udp_dst=" + strconv.Itoa(int(port.Port))
-				}
-				cmdexecutor(exec.Command("ovs-ofctl", "-O", "OpenFlow13", "add-flow", "br0",
-					"table=1,priority=100,ip,nw_dst="+service.ClusterIP+protocol+
-						",actions=mod_tp_dst:"+strconv.Itoa(int(port.Port))+",group:"+
-						strconv.Itoa(int(service.OvsGroup))), true)
+	// The flows of the previous run are replaced in a single transaction,
+	// like ovs-ofctl replace-flows traffic never sees an empty table.
+	catchMsgs := replaceNatCatchFlows()
+	var serviceMsgs [][]openflow.Message
+	for _, service := range services {
+		msgs := serviceMessages(service)
+		for _, msg := range msgs {
+			// groups that survived a restart are modified in place
+			if group, ok := msg.(*openflow.GroupMod); ok && groupIds.exists(int(group.GroupID)) {
+				group.Command = openflow.GroupModify
 			}
 		}
+		serviceMsgs = append(serviceMsgs, msgs)
 	}
-}
-
-func delSvcOvs(service K8ssvc) {
-	// Delete Service from OVS
-	flowdelstring := "table=1, ip, nw_dst=" + service.ClusterIP
-	groupdelstring := "group_id:" + strconv.Itoa(int(service.OvsGroup))
-	cmdexecutor(exec.Command("ovs-ofctl", "-O", "OpenFlow13", "del-flows", "br0", flowdelstring), true)
-	cmdexecutor(exec.Command("ovs-ofctl", "-O", "OpenFlow13", "del-groups", "br0", groupdelstring), true)
-}
-
-func repOvsGroup(service K8ssvc) {
-	// Delete and re-add group from OVS (The better solution is insert-buckets - TODO)
-	delSvcOvs(service)
-	// add a new Service Group to OVS
-	addOvsSvc(service)
-}
-
-func addNatOVScatch() bool {
-	// adds the catch flow rule for CT Nat'ed established connections
-	cmdexecutor(exec.Command("ovs-ofctl", "-O", "OpenFlow13", "del-flows", "br0", "table=1,ip"), true)
-	result := cmdexecutor(exec.Command("ovs-ofctl", "-O", "OpenFlow13", "add-flow", "br0",
-		"table=1,priority=90,ip,action=ct(table=2,nat)"), true)
-	if result == "" {
-		return true
+	stale := groupIds.stale()
+	if len(stale) > 0 {
+		Info.Printf("Deleting stale groups %v", stale)
 	}
-	return false
-}
-
-func createInitialSvc(services []K8ssvc) {
-	// Create all services that were retrieved on Init
-	Info.Printf("Creating initial set of services in OVS")
-	if !addNatOVScatch() {
+	msgs := catchMsgs
+	for _, svcMsgs := range serviceMsgs {
+		msgs = append(msgs, svcMsgs...)
+	}
+	if ofexecutor(append(msgs, delGroupMessages(stale)...)...) == nil {
+		return
+	}
+	// a single broken service fails the whole transaction, the others are programmed on their own
+	Error.Printf("Failed to create the initial services at once, creating them one by one")
+	if ofexecutor(catchMsgs...) != nil {
 		Error.Printf("Failed to add initial flow entries, is Kubelet with the OVS Plugin started?")
 	}
-	for _, service := range services {
-		addOvsSvc(service)
+	for _, svcMsgs := range serviceMsgs {
+		ofexecutor(svcMsgs...)
+	}
+	if len(stale) > 0 {
+		ofexecutor(delGroupMessages(stale)...)
 	}
 }
 
-func getallsvc(client *client.Client) []K8ssvc {
-	// retrieve Service List for all Services
-	Info.Printf("retrieving complete service list from K8s master")
-	svcs, err := client.Services(api.NamespaceDefault).List(listopt)
-	if err != nil {
-		Error.Printf("could not get a service Object from the K8s API")
+// reasons a Service is not proxied
+const (
+	SkipHeadless     string = "headless"
+	SkipExternalName string = "ExternalName"
+	SkipNoClusterIP  string = "no cluster IP"
+	SkipUnknownType  string = "unknown type"
+	SkipTooLong      string = "too many endpoints for an OpenFlow group"
+)
+
+func skipReason(svcObject *api.Service) string {
+	// the proxy only programs Services with a cluster IP, the 1.3 API has no constant for ExternalName
+	switch svcObject.Spec.Type {
+	case "", api.ServiceTypeClusterIP, api.ServiceTypeNodePort, api.ServiceTypeLoadBalancer:
+	case "ExternalName":
+		return SkipExternalName
+	default:
+		return SkipUnknownType
 	}
-	// retrieve all services and populate service struct
-	ovsGroupId := 99
-	services := []K8ssvc{}
-	for _, item := range svcs.Items {
-		ovsGroupId++
-		svcToAdd := constructService(client, &item)
-		addServiceToArray(client, 0, &svcToAdd, &services, ovsGroupId)
+	if svcObject.Spec.ClusterIP == api.ClusterIPNone {
+		return SkipHeadless
 	}
-	return services
+	if net.ParseIP(svcObject.Spec.ClusterIP) == nil {
+		return SkipNoClusterIP
+	}
+	return ""
 }
 
-func constructService(client *client.Client, svcObject *api.Service) K8ssvc {
+func constructService(svcObject *api.Service, endpoints *api.Endpoints) K8ssvc {
+	// builds the internal service from the cached Service and its Endpoints, which may not exist yet
 	var service K8ssvc
 	service.Name = svcObject.Name
 	service.Namespace = svcObject.Namespace
 	service.Uid = svcObject.UID
-	service.Ports = svcObject.Spec.Ports
+	service.Ports = supportedPorts(svcObject)
 	service.ClusterIP = svcObject.Spec.ClusterIP
-	endpoints, _ := client.Endpoints(svcObject.Namespace).Get(svcObject.Name)
-	service.Endpoints = endpoints.Subsets
-	service.EndpointsUid = endpoints.UID
+	service.ClusterIPs = clusterIPs(svcObject)
+	service.ExternalIPs = svcObject.Spec.ExternalIPs
+	for _, ingress := range svcObject.Status.LoadBalancer.Ingress {
+		// ingress points with only a hostname can't be matched in OVS
+		if ingress.IP != "" {
+			service.IngressIPs = append(service.IngressIPs, ingress.IP)
+		}
+	}
+	service.SessionAffinity = svcObject.Spec.SessionAffinity
+	service.AffinityTimeout = DefaultAffinityTimeout
+	if timeout, ok := svcObject.Annotations[AffinityTimeoutAnnotation]; ok {
+		seconds, err := strconv.Atoi(timeout)
+		if err != nil || seconds <= 0 {
+			Error.Printf("Ignoring invalid affinity timeout %s of Service %s", timeout, svcObject.Name)
+		} else {
+			service.AffinityTimeout = seconds
+		}
+	}
+	if service.AffinityTimeout > MaxAffinityTimeout {
+		service.AffinityTimeout = MaxAffinityTimeout
+	}
+	service.ExternalLocal = svcObject.Annotations[ExternalTrafficAnnotation] == TrafficPolicyLocal
+	service.InternalLocal = svcObject.Annotations[InternalTrafficAnnotation] == TrafficPolicyLocal
+	service.TopologyAware = svcObject.Annotations[TopologyAwareAnnotation] == "true"
+	if endpoints != nil {
+		service.Endpoints = endpoints.Subsets
+		service.EndpointsUid = endpoints.UID
+	}
 	service.Deleted = false
 	return service
 }
 
-func addServiceToArray(client *client.Client, replaceIndex int, newService *K8ssvc, services *[]K8ssvc, ovsGroupId int) {
-	// Adds new services to internal Services Slice
-	if replaceIndex == 0 {
-		newService.OvsGroup = ovsGroupId
+func supportedPorts(svcObject *api.Service) []api.ServicePort {
+	// a port without protocol match would catch all traffic to the service IPs, such ports are left out
+	var ports []api.ServicePort
+	for _, port := range svcObject.Spec.Ports {
+		if ipProto(port.Protocol) == 0 {
+			Error.Printf("Ignoring port %s of Service %s, protocol %q is not supported", port.Name,
+				serviceKey(svcObject.Namespace, svcObject.Name), port.Protocol)
+			continue
+		}
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+func clusterIPs(svcObject *api.Service) []string {
+	// the primary cluster IP and a second one of the other family of dual-stack Services
+	ips := []string{svcObject.Spec.ClusterIP}
+	list, ok := svcObject.Annotations[ClusterIPsAnnotation]
+	if !ok || net.ParseIP(svcObject.Spec.ClusterIP) == nil {
+		return ips
+	}
+	for _, ip := range strings.Split(list, ",") {
+		ip = strings.TrimSpace(ip)
+		if ip == svcObject.Spec.ClusterIP {
+			continue
+		}
+		if net.ParseIP(ip) == nil || isIPv6(ip) == isIPv6(svcObject.Spec.ClusterIP) || len(ips) > 1 {
+			Error.Printf("Ignoring cluster IP %s of Service %s, a Service has one address per family", ip, svcObject.Name)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func addServiceToArray(replaceIndex int, newService *K8ssvc, services *[]K8ssvc) {
+	// Adds new services to internal Services Slice, a negative index appends
+	if replaceIndex < 0 {
 		*services = append(*services, *newService)
 	} else {
-		newService.OvsGroup = ovsGroupId
 		(*services)[replaceIndex] = *newService
 	}
 }
 
-func addrInSubsets(currentSvc []api.EndpointSubset, addr api.EndpointAddress) bool {
+func serviceKey(namespace string, name string) string {
+	// internal services are keyed by namespace/name, the UID tells apart re-created objects
+	return namespace + "/" + name
+}
+
+func findServiceByKey(services []K8ssvc, key string) int {
+	// returns the index of the active service with the namespace/name key, whatever its UID, or -1
+	for index, service := range services {
+		if !service.Deleted && serviceKey(service.Namespace, service.Name) == key {
+			return index
+		}
+	}
+	return -1
+}
+
+func endpointKey(subset api.EndpointSubset, addr api.EndpointAddress) string {
+	// pods are identified by their UID, manually managed Endpoints have no TargetRef
+	// and are identified by their IP and ports
+	if addr.TargetRef != nil {
+		return string(addr.TargetRef.UID)
+	}
+	key := addr.IP
+	for _, port := range subset.Ports {
+		key += ":" + strconv.Itoa(int(port.Port))
+	}
+	return key
+}
+
+func addrInSubsets(currentSvc []api.EndpointSubset, key string) bool {
 	for _, sub := range currentSvc {
 		for _, addrItem := range sub.Addresses {
-			if addr.TargetRef.UID == addrItem.TargetRef.UID {
+			if endpointKey(sub, addrItem) == key {
 				return true
 			}
 		}
@@ -223,11 +301,11 @@ func addrInSubsets(currentSvc []api.EndpointSubset, addr api.EndpointAddress) bo
 	return false
 }
 
-func endpointDiff(modEndpoints api.Endpoints, svcEndpoints []api.EndpointSubset) (added []api.EndpointAddress, removed []api.EndpointAddress) {
+func endpointDiff(modEndpoints []api.EndpointSubset, svcEndpoints []api.EndpointSubset) (added []api.EndpointAddress, removed []api.EndpointAddress) {
 	// If the modified services has more Addresses than the existing, add them
-	for _, sub := range modEndpoints.Subsets {
+	for _, sub := range modEndpoints {
 		for _, addr := range sub.Addresses {
-			if !addrInSubsets(svcEndpoints, addr) {
+			if !addrInSubsets(svcEndpoints, endpointKey(sub, addr)) {
 				added = append(added, addr)
 			}
 		}
@@ -235,7 +313,7 @@ func endpointDiff(modEndpoints api.Endpoints, svcEndpoints []api.EndpointSubset)
 	// if the existing service has more Addresses than the modified, delete them
 	for _, sub := range svcEndpoints {
 		for _, addr := range sub.Addresses {
-			if !addrInSubsets(modEndpoints.Subsets, addr) {
+			if !addrInSubsets(modEndpoints, endpointKey(sub, addr)) {
 				removed = append(removed, addr)
 			}
 		}
@@ -243,147 +321,264 @@ func endpointDiff(modEndpoints api.Endpoints, svcEndpoints []api.EndpointSubset)
 	return added, removed
 }
 
-func modifyEndpoints(endpointsObj *api.Endpoints, services *[]K8ssvc) {
+func addSvc(addedService K8ssvc, services *[]K8ssvc) error {
+	// called if a service appears in the cache, reuses the slot of a deleted service
+	svcIndex := -1
+	Info.Printf("New Service %s Added\n", serviceKey(addedService.Namespace, addedService.Name))
 	for index, service := range *services {
-		if service.EndpointsUid == endpointsObj.UID {
-			Info.Printf("Endpoints for Service %s modified", endpointsObj.Name)
-			addedAddr, remAddr := endpointDiff(*endpointsObj, service.Endpoints)
-			Info.Printf("Added Addresses: %s , Removed Adresses: %s\n", addedAddr, remAddr)
-			(*services)[index].Endpoints = endpointsObj.Subsets
-			repOvsGroup((*services)[index])
+		if service.Deleted {
+			svcIndex = index
+			break
+		}
+	}
+	assignGroups(&addedService, nil)
+	addServiceToArray(svcIndex, &addedService, services)
+	if err := addOvsSvc(addedService); err != nil {
+		if err == openflow.ErrTooLong {
+			// nothing was sent, retrying can't help until the endpoints change
+			Error.Printf("Service %s has too many endpoints for an OpenFlow group, not programming it",
+				serviceKey(addedService.Namespace, addedService.Name))
+		} else {
+			// forget the half programmed service, the retry adds it from scratch
+			delSvcOvs(addedService)
 		}
+		releaseGroups(serviceGroups(addedService))
+		if svcIndex < 0 {
+			svcIndex = len(*services) - 1
+		}
+		(*services)[svcIndex].Deleted = true
+		return err
 	}
+	return nil
 }
 
-func addSvc(client *client.Client, eventObject runtime.Object, services *[]K8ssvc) bool {
-	// called if service gets added in K8s
-	mutex.Lock()
-	defer mutex.Unlock()
-	addedService := constructService(client, eventObject.(*api.Service))
-	ovsGroupId := 0
-	svcIndex := 0
-	Info.Printf("New Service %s Added\n", addedService.Name)
-	for index, service := range *services {
-		if service.Uid == addedService.Uid {
-			Info.Printf("Service %s is already existing, skipping", addedService.Name)
-			return false
-		} else if service.Deleted {
-			svcIndex = index
-			ovsGroupId = service.OvsGroup
+func portDiff(oldPorts []api.ServicePort, newPorts []api.ServicePort) (added []api.ServicePort, removed []api.ServicePort) {
+	// ports are compared as a whole, a changed protocol or port number is a remove plus an add
+	for _, newPort := range newPorts {
+		found := false
+		for _, oldPort := range oldPorts {
+			if newPort == oldPort {
+				found = true
+			}
+		}
+		if !found {
+			added = append(added, newPort)
 		}
 	}
-	if svcIndex == 0 {
-		ovsGroupId = len(*services) + 100
+	for _, oldPort := range oldPorts {
+		found := false
+		for _, newPort := range newPorts {
+			if newPort == oldPort {
+				found = true
+			}
+		}
+		if !found {
+			removed = append(removed, oldPort)
+		}
 	}
-	addServiceToArray(client, svcIndex, &addedService, services, ovsGroupId)
-	addOvsSvc(addedService)
-	return true
+	return added, removed
 }
 
-func modSvc(client *client.Client, eventObject runtime.Object, services *[]K8ssvc) {
-	// called if service gets added in K8s
-	// nothing implemented yet
-	Info.Printf("Service %s Modified\n", eventObject)
+func stringInSlice(item string, list []string) bool {
+	for _, listItem := range list {
+		if listItem == item {
+			return true
+		}
+	}
+	return false
 }
 
-func delSvc(client *client.Client, eventObject runtime.Object, services *[]K8ssvc) {
-	// called if service gets added in K8s
-	mutex.Lock()
-	defer mutex.Unlock()
-	deletedService := constructService(client, eventObject.(*api.Service))
-	Info.Printf("Service %s Deleted\n", deletedService.Name)
-	for index, service := range *services {
-		if service.Uid == deletedService.Uid {
-			if service.Deleted {
-				Info.Printf("Service %s is already Deleted, skipping", deletedService.Name)
-			} else {
-				Info.Printf("Deleting service: %s", service.Name)
-				(*services)[index].Deleted = true
-				delSvcOvs(service)
-			}
+func stringDiff(oldList []string, newList []string) (added []string, removed []string) {
+	for _, item := range newList {
+		if !stringInSlice(item, oldList) {
+			added = append(added, item)
+		}
+	}
+	for _, item := range oldList {
+		if !stringInSlice(item, newList) {
+			removed = append(removed, item)
 		}
 	}
+	return added, removed
 }
 
-func addEndpoints(client *client.Client, eventObject runtime.Object, services *[]K8ssvc) {
-	// called if full Endpoint list is Added
-	// not implemented yet - not sure when this is called
-	Info.Printf("Endpoints ADDED")
+func modSvc(index int, modifiedService K8ssvc, services *[]K8ssvc) error {
+	// called if the Service or its Endpoints changed, only the changed flows and buckets are reprogrammed
+	currentService := (*services)[index]
+	assignGroups(&modifiedService, currentService.OvsGroups)
+	(*services)[index] = modifiedService
+	err := programModifiedSvc(currentService, modifiedService)
+	if err == openflow.ErrTooLong {
+		// nothing was sent, the service keeps its last programmed state
+		Error.Printf("Service %s has too many endpoints for an OpenFlow group, keeping its previous endpoints",
+			serviceKey(modifiedService.Namespace, modifiedService.Name))
+		releaseGroups(groupsNotIn(modifiedService, currentService.OvsGroups))
+		(*services)[index] = currentService
+		return err
+	}
+	if err != nil {
+		// the retry computes the same differences again, groups of new ports are allocated again as well
+		newGroups := groupsNotIn(modifiedService, currentService.OvsGroups)
+		ofexecutor(delGroupMessages(newGroups)...)
+		releaseGroups(newGroups)
+		(*services)[index] = currentService
+		return err
+	}
+	releaseGroups(groupsNotIn(currentService, modifiedService.OvsGroups))
+	return nil
 }
 
-func modEndpoints(client *client.Client, eventObject runtime.Object, services *[]K8ssvc) {
-	// called when Endpoints are modified, e.g. when Pods with the right tags are started
-	// not implemented yet - not sure when this is called
-	Info.Printf("Endpoint MODIFIED")
-	modifyEndpoints(eventObject.(*api.Endpoints), services)
+func programModifiedSvc(currentService K8ssvc, modifiedService K8ssvc) error {
+	addedAddr, remAddr := endpointDiff(modifiedService.Endpoints, currentService.Endpoints)
+	if len(addedAddr) > 0 || len(remAddr) > 0 {
+		Info.Printf("Endpoints of Service %s changed, Added Addresses: %v , Removed Adresses: %v\n",
+			serviceKey(modifiedService.Namespace, modifiedService.Name), addedAddr, remAddr)
+	}
+
+	// new groups have to exist before flows point to them, the ones no longer needed go last
+	var newGroups, keptGroups []portGroup
+	for _, pg := range portGroups(modifiedService) {
+		if _, ok := currentService.OvsGroups[pg.name()]; ok {
+			keptGroups = append(keptGroups, pg)
+		} else {
+			newGroups = append(newGroups, pg)
+		}
+	}
+	msgs := groupMessages(modifiedService, newGroups, openflow.GroupAdd)
+	removedGroups := delGroupMessages(groupsNotIn(currentService, modifiedService.OvsGroups))
+
+	if currentService.SessionAffinity != modifiedService.SessionAffinity ||
+		currentService.ExternalLocal != modifiedService.ExternalLocal || currentService.InternalLocal != modifiedService.InternalLocal {
+		// the actions of all flows change, reprogram the complete service with the same groups
+		Info.Printf("Session affinity or traffic policy of Service %s changed", serviceKey(modifiedService.Namespace, modifiedService.Name))
+		msgs = append(msgs, delOvsFlows(currentService, serviceIPs(currentService), currentService.Ports)...)
+		msgs = append(msgs, delNodePortFlows(currentService, currentService.Ports)...)
+		for _, pg := range keptGroups {
+			msgs = append(msgs, delAffinityFlows(modifiedService.OvsGroups[pg.name()])...)
+		}
+		msgs = append(msgs, groupMessages(modifiedService, keptGroups, openflow.GroupModify)...)
+		msgs = append(msgs, ovsFlows(modifiedService, serviceIPs(modifiedService), modifiedService.Ports)...)
+		msgs = append(msgs, nodePortFlows(modifiedService, modifiedService.Ports)...)
+		return ofexecutor(append(msgs, removedGroups...)...)
+	}
+	for _, pg := range keptGroups {
+		currentPort, _ := portByName(currentService.Ports, pg.Port.Name)
+		currentPG := portGroup{Port: currentPort, Local: pg.Local}
+		if !openflow.BucketsEqual(constructBuckets(currentService, currentPG), constructBuckets(modifiedService, pg)) {
+			Info.Printf("Reprogramming group %d of Service %s port %s", modifiedService.OvsGroups[pg.name()],
+				modifiedService.Name, pg.name())
+			msgs = append(msgs, constructGroup(modifiedService, pg, openflow.GroupModify))
+			msgs = append(msgs, updAffinityFlows(currentService, modifiedService, currentPG, pg)...)
+		}
+	}
+	addedIPs, removedIPs := stringDiff(serviceIPs(currentService), serviceIPs(modifiedService))
+	addedPorts, removedPorts := portDiff(currentService.Ports, modifiedService.Ports)
+	if len(addedIPs) > 0 || len(removedIPs) > 0 {
+		Info.Printf("Service IPs changed, added: %v, removed: %v", addedIPs, removedIPs)
+	}
+	if len(addedPorts) > 0 || len(removedPorts) > 0 {
+		Info.Printf("Ports changed, added: %v, removed: %v", addedPorts, removedPorts)
+	}
+	var keptIPs []string
+	for _, ip := range serviceIPs(modifiedService) {
+		if !stringInSlice(ip, addedIPs) {
+			keptIPs = append(keptIPs, ip)
+		}
+	}
+	msgs = append(msgs, delOvsFlows(currentService, removedIPs, currentService.Ports)...)
+	msgs = append(msgs, delOvsFlows(currentService, keptIPs, removedPorts)...)
+	msgs = append(msgs, delNodePortFlows(currentService, removedPorts)...)
+	msgs = append(msgs, ovsFlows(modifiedService, addedIPs, modifiedService.Ports)...)
+	msgs = append(msgs, ovsFlows(modifiedService, keptIPs, addedPorts)...)
+	msgs = append(msgs, nodePortFlows(modifiedService, addedPorts)...)
+	msgs = append(msgs, removedGroups...)
+	if len(msgs) == 0 {
+		return nil
+	}
+	Info.Printf("Service %s Modified\n", serviceKey(modifiedService.Namespace, modifiedService.Name))
+	return ofexecutor(msgs...)
 }
 
-func delEndpoints(client *client.Client, eventObject runtime.Object, services *[]K8ssvc) {
-	// called when full Endpoint List is Deleted
-	Info.Printf("Endpoint DELETED")
+func delSvc(index int, services *[]K8ssvc) error {
+	// called if a service is gone from the cache, its slot and group id are reused by later services
+	deletedService := (*services)[index]
+	Info.Printf("Deleting service: %s", serviceKey(deletedService.Namespace, deletedService.Name))
+	(*services)[index].Deleted = true
+	if err := delSvcOvs(deletedService); err != nil {
+		(*services)[index].Deleted = false
+		return err
+	}
+	releaseGroups(serviceGroups(deletedService))
+	return nil
 }
 
 func main() {
-	if len(os.Args) > 1 {
-		Host = os.Args[1]
+	cfg, err := loadConfig(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
 	}
+	if err != nil {
+		// nothing is started with a broken configuration
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	}
+	cfg.apply()
 
-	logfile := openlog("/tmp/watcher.log")
+	logfile := openlog(cfg.LogFile)
 	defer logfile.Close()
-	multi := io.MultiWriter(logfile, os.Stdout)
+	var multi io.Writer = io.MultiWriter(logfile, os.Stdout)
+	if cfg.DryRun == "-" || cfg.DryRunGroups == "-" {
+		// stdout only carries the messages
+		multi = logfile
+	}
 	Info = log.New(multi, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
 	Error = log.New(multi, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
 
-	config := &restclient.Config{Host: Host, Insecure: true}
-
-	client := createapiclient(config)
-	svcs := getallsvc(client)
-	createInitialSvc(svcs)
-
-	watchSvcObj, err := client.Services(api.NamespaceDefault).Watch(listopt)
-	if err != nil {
-		Error.Printf("could not set a watch on service Objects with the K8s API")
-	}
-	watchSvcChan := watchSvcObj.ResultChan()
-
-	watchEndpointObj, err := client.Endpoints(api.NamespaceDefault).Watch(listopt)
-	if err != nil {
-		Error.Printf("could not set a watch on Endpoints Objects with the K8s API")
-	}
-	watchEndpointChan := watchEndpointObj.ResultChan()
-
-	for {
-		select {
-		case endpointsWatch := <-watchEndpointChan:
-			if endpointsWatch.Type != "" {
-				Info.Printf("receive on channel is %s, type %s %T \n", endpointsWatch, endpointsWatch.Type, endpointsWatch.Type)
-				Info.Printf("Received Endpoints Details: \n%s\n", formatK8endpointJson(endpointsWatch.Object.(*api.Endpoints)))
-				switch endpointsWatch.Type {
-				case "ADDED":
-					addEndpoints(client, endpointsWatch.Object, &svcs)
-				case "DELETED":
-					delEndpoints(client, endpointsWatch.Object, &svcs)
-				case "MODIFIED":
-					modEndpoints(client, endpointsWatch.Object, &svcs)
-				}
+	NodeName = getNodeName()
+	Info.Printf("Running on node %s", NodeName)
+	NodeIPs = getNodeIPs()
+	Info.Printf("Node addresses used for NodePort services: %v", NodeIPs)
+
+	if cfg.DryRun != "" {
+		// nothing is read from OVS either, the output starts from an empty bridge
+		flows, groups := openDryRun(cfg.DryRun), openDryRun(cfg.DryRunGroups)
+		defer flows.Close()
+		defer groups.Close()
+		dryRunFlows, dryRunGroups = flows, groups
+		Info.Printf("Dry-run, writing the flows to %s and the groups to %s", cfg.DryRun, cfg.DryRunGroups)
+	} else {
+		ofconn, err = openflow.Dial(Bridge)
+		if err != nil {
+			Error.Fatalf("could not open an OpenFlow connection to %s: %s", Bridge, err)
+		}
+		defer ofconn.Close()
+		if cfg.Cleanup {
+			if err := cleanup(); err != nil {
+				Error.Fatalf("Cleanup failed: %s", err)
 			}
-		case serviceWatch := <-watchSvcChan:
-			if serviceWatch.Type != "" {
-				Info.Printf("receive on channel is %s, type %s %T \n", serviceWatch, serviceWatch.Type, serviceWatch.Type)
-				Info.Printf("Received Service Details: \n%s\n", formatK8svcJson(serviceWatch.Object.(*api.Service)))
-				switch serviceWatch.Type {
-				case "ADDED":
-					time.Sleep(500 * time.Millisecond)
-					addSvc(client, serviceWatch.Object, &svcs)
-				case "DELETED":
-					time.Sleep(500 * time.Millisecond)
-					delSvc(client, serviceWatch.Object, &svcs)
-				case "MODIFIED":
-					time.Sleep(500 * time.Millisecond)
-					delSvc(client, serviceWatch.Object, &svcs)
-				}
+			return
+		}
+		if err := groupIds.recover(ofconn); err != nil {
+			Error.Printf("could not recover the group ids from OVS, starting with a clean allocator: %s", err)
+			groupIds = newGroupAllocator()
+		} else if StateFile != "" {
+			snapshot, err := readSnapshot(StateFile)
+			if err == nil {
+				groupIds.restore(snapshot)
+			} else if !os.IsNotExist(err) {
+				Error.Printf("could not read the state snapshot %s: %s", StateFile, err)
 			}
 		}
 	}
 
+	if MetricsAddress != "" {
+		go serveMetrics(MetricsAddress)
+	}
+
+	client := createapiclient(cfg)
+	controller := newServiceController(client)
+	controller.Run()
+	if DebugSocket != "" && !dryRun() {
+		os.Remove(DebugSocket)
+	}
 }
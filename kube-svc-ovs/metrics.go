@@ -0,0 +1,191 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"sync"
+)
+
+const MetricsNamespace string = "kube_svc_ovs"
+
+// address of the metrics server, set from the Config
+var MetricsAddress string
+
+var (
+	programmedServices = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "services",
+		Help:      "Number of services programmed in OVS.",
+	})
+	programmedGroups = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "groups",
+		Help:      "Number of OpenFlow groups programmed for services.",
+	})
+	programmedBuckets = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "buckets",
+		Help:      "Number of endpoint buckets in the service groups.",
+	})
+	skippedServices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "skipped_services",
+		Help:      "Number of services that are not proxied, like headless and ExternalName ones, by reason.",
+	}, []string{"reason"})
+	watchEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "watch_events_total",
+		Help:      "Informer events by resource and type.",
+	}, []string{"resource", "type"})
+	syncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Latency of service syncs and reconciler runs.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"kind", "result"})
+	openflowDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "openflow_duration_seconds",
+		Help:      "Latency of OpenFlow message batches up to the barrier reply.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 15),
+	})
+	openflowMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "openflow_messages_total",
+		Help:      "OpenFlow messages sent by ovs-ofctl command equivalent.",
+	}, []string{"command"})
+	openflowFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "openflow_failures_total",
+		Help:      "OpenFlow message batches OVS rejected or didn't confirm.",
+	})
+	reconcileDrift = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "reconcile_drift",
+		Help:      "Flows and groups repaired by the last reconciler run.",
+	})
+	reconcileRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "reconcile_repairs_total",
+		Help:      "Flows and groups repaired by the reconciler by object and action.",
+	}, []string{"object", "action"})
+)
+
+// groupOwner is the service port a group balances, the label set of its counters
+type groupOwner struct {
+	Namespace string
+	Name      string
+	PortGroup string
+}
+
+// serviceStatsCollector reads the packet and byte counters of the service
+// groups from OVS on every scrape. The owners of the groups are published
+// by the sync loop, which is the only one touching the services.
+type serviceStatsCollector struct {
+	mu      sync.Mutex
+	owners  map[uint32]groupOwner
+	packets *prometheus.Desc
+	bytes   *prometheus.Desc
+}
+
+var serviceStats = &serviceStatsCollector{
+	owners: make(map[uint32]groupOwner),
+	packets: prometheus.NewDesc(MetricsNamespace+"_service_packets_total",
+		"Packets balanced by the group of a service port.", []string{"namespace", "service", "port_group"}, nil),
+	bytes: prometheus.NewDesc(MetricsNamespace+"_service_bytes_total",
+		"Bytes balanced by the group of a service port.", []string{"namespace", "service", "port_group"}, nil),
+}
+
+func (s *serviceStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.packets
+	ch <- s.bytes
+}
+
+func (s *serviceStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	if dryRun() {
+		return
+	}
+	stats, err := ofconn.DumpGroupStats()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(s.packets, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stat := range stats {
+		owner, ok := s.owners[stat.GroupID]
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(s.packets, prometheus.CounterValue, float64(stat.PacketCount),
+			owner.Namespace, owner.Name, owner.PortGroup)
+		ch <- prometheus.MustNewConstMetric(s.bytes, prometheus.CounterValue, float64(stat.ByteCount),
+			owner.Namespace, owner.Name, owner.PortGroup)
+	}
+}
+
+func (s *serviceStatsCollector) setOwners(owners map[uint32]groupOwner) {
+	s.mu.Lock()
+	s.owners = owners
+	s.mu.Unlock()
+}
+
+func updateServiceMetrics(services []K8ssvc, skipped map[string]string) {
+	// called by the sync loop after the services changed
+	var serviceCount, groupCount, bucketCount int
+	owners := make(map[uint32]groupOwner)
+	for _, service := range services {
+		if service.Deleted {
+			continue
+		}
+		serviceCount++
+		for _, pg := range portGroups(service) {
+			group, ok := service.OvsGroups[pg.name()]
+			if !ok {
+				continue
+			}
+			groupCount++
+			bucketCount += len(portEndpoints(service, pg))
+			owners[uint32(group)] = groupOwner{Namespace: service.Namespace, Name: service.Name, PortGroup: pg.name()}
+		}
+	}
+	programmedServices.Set(float64(serviceCount))
+	programmedGroups.Set(float64(groupCount))
+	programmedBuckets.Set(float64(bucketCount))
+	skippedServices.Reset()
+	for _, reason := range skipped {
+		skippedServices.WithLabelValues(reason).Inc()
+	}
+	serviceStats.setOwners(owners)
+}
+
+func observeReconcile(report reconcileReport) {
+	reconcileDrift.Set(float64(report.drift()))
+	reconcileRepairs.WithLabelValues("flow", "added").Add(float64(report.FlowsAdded))
+	reconcileRepairs.WithLabelValues("flow", "modified").Add(float64(report.FlowsModified))
+	reconcileRepairs.WithLabelValues("flow", "deleted").Add(float64(report.FlowsDeleted))
+	reconcileRepairs.WithLabelValues("group", "added").Add(float64(report.GroupsAdded))
+	reconcileRepairs.WithLabelValues("group", "modified").Add(float64(report.GroupsChanged))
+	reconcileRepairs.WithLabelValues("group", "deleted").Add(float64(report.GroupsDeleted))
+}
+
+func syncResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+func serveMetrics(address string) {
+	prometheus.MustRegister(programmedServices, programmedGroups, programmedBuckets, skippedServices, watchEvents, syncDuration,
+		openflowDuration, openflowMessages, openflowFailures, reconcileDrift, reconcileRepairs, serviceStats)
+	http.Handle("/metrics", prometheus.Handler())
+	Info.Printf("Serving metrics on %s", address)
+	if err := http.ListenAndServe(address, nil); err != nil {
+		Error.Printf("Metrics server stopped: %s", err)
+	}
+}
+
+func countEvent(resource string, eventType string) {
+	watchEvents.WithLabelValues(resource, eventType).Inc()
+}
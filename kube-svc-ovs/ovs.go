@@ -0,0 +1,461 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/yfauser/gocode/openflow"
+	"k8s.io/kubernetes/pkg/api"
+	"net"
+	"time"
+)
+
+// cleared if the switch doesn't support bundles, the messages are then sent one by one
+var useBundles = true
+
+func ofexecutor(msgs ...openflow.Message) error {
+	// sends all messages as one transaction, packets see the state before or after all of them
+	for _, msg := range msgs {
+		Info.Printf("Sending %s %s\n", ofCommandName(msg), msg)
+		openflowMessages.WithLabelValues(ofCommandName(msg)).Inc()
+	}
+	if dryRun() {
+		return writeDryRun(msgs)
+	}
+	start := time.Now()
+	err := sendMessages(msgs)
+	openflowDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		Error.Printf("OpenFlow messages returned failure: %s\n", err)
+		openflowFailures.Inc()
+	}
+	return err
+}
+
+func sendMessages(msgs []openflow.Message) error {
+	if useBundles {
+		err := ofconn.SendBundle(msgs...)
+		if err != openflow.ErrBundlesUnsupported {
+			return err
+		}
+		Error.Printf("OVS does not support OpenFlow bundles, changes are no longer applied atomically")
+		useBundles = false
+	}
+	return ofconn.Send(msgs...)
+}
+
+func checkLength(msgs []openflow.Message) error {
+	// a bundle wraps every message in a bundle add, which has to fit as well
+	if useBundles {
+		return openflow.CheckBundleLength(msgs...)
+	}
+	return openflow.CheckLength(msgs...)
+}
+
+func ofCommandName(msg openflow.Message) string {
+	// ovs-ofctl command equivalent of the message, used for logging
+	switch m := msg.(type) {
+	case *openflow.FlowMod:
+		if m.Command == openflow.FlowDelete || m.Command == openflow.FlowDeleteStrict {
+			return "del-flows"
+		}
+		return "add-flow"
+	case *openflow.GroupMod:
+		switch m.Command {
+		case openflow.GroupModify:
+			return "mod-group"
+		case openflow.GroupDelete:
+			return "del-groups"
+		}
+		return "add-group"
+	}
+	return "message"
+}
+
+func addFlow(table uint8, priority uint16, match openflow.Match, actions ...openflow.Action) *openflow.FlowMod {
+	// the cookie tells the flows of the proxy apart from the ones of the plugin
+	return &openflow.FlowMod{Command: openflow.FlowAdd, Table: table, Priority: priority, Cookie: ProxyCookie,
+		Match: match, Actions: actions}
+}
+
+func delFlows(table uint8, match openflow.Match) *openflow.FlowMod {
+	return &openflow.FlowMod{Command: openflow.FlowDelete, Table: table, Match: match}
+}
+
+func ipToReg(ip string) uint32 {
+	// IPv4 address as value to be loaded into a register
+	ipv4 := net.ParseIP(ip).To4()
+	if ipv4 == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ipv4)
+}
+
+func isIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+func ipEthType(ip string) uint16 {
+	if isIPv6(ip) {
+		return openflow.EthTypeIPv6
+	}
+	return openflow.EthTypeIPv4
+}
+
+func nodeMark(index int) uint32 {
+	// NodePort traffic carries the index of the node address in reg1, an IPv6 address doesn't fit
+	return uint32(index + 1)
+}
+
+func ipProto(protocol api.Protocol) uint8 {
+	// 0 for protocols OVS can't match ports of, the 1.3 API has no constant for SCTP
+	switch protocol {
+	case "TCP":
+		return openflow.IPProtoTCP
+	case "UDP":
+		return openflow.IPProtoUDP
+	case "SCTP":
+		return openflow.IPProtoSCTP
+	}
+	return 0
+}
+
+func constructNat(ip string, port int32) openflow.Action {
+	// DNAT to the endpoint, committed and continued in the egress table
+	return &openflow.Conntrack{Commit: true, Recirc: true, Table: EgressTable, Actions: []openflow.Action{
+		&openflow.Nat{Flags: openflow.NatDst, IP: net.ParseIP(ip), Port: uint16(port)}}}
+}
+
+// endpoint is an address and port traffic of a service port is DNAT'ed to
+type endpoint struct {
+	IP   string
+	Port int32
+}
+
+func portByName(ports []api.ServicePort, name string) (api.ServicePort, bool) {
+	for _, port := range ports {
+		if port.Name == name {
+			return port, true
+		}
+	}
+	return api.ServicePort{}, false
+}
+
+func portEndpoints(service K8ssvc, pg portGroup) []endpoint {
+	// the endpoints controller names the endpoint ports after the service ports and
+	// resolves named targetPorts, so the endpoint port is found by name and protocol
+	var endpoints []endpoint
+	for _, subset := range service.Endpoints {
+		for _, endpointPort := range subset.Ports {
+			if endpointPort.Name != pg.Port.Name || endpointPort.Protocol != pg.Port.Protocol {
+				continue
+			}
+			for _, ip := range subset.Addresses {
+				if isIPv6(ip.IP) != pg.IPv6 || (pg.Local && !service.Topology[ip.IP].Local) {
+					continue
+				}
+				endpoints = append(endpoints, endpoint{IP: ip.IP, Port: endpointPort.Port})
+			}
+		}
+	}
+	return endpoints
+}
+
+func constructBuckets(service K8ssvc, pg portGroup) []openflow.Bucket {
+	var buckets []openflow.Bucket
+	for _, ep := range portEndpoints(service, pg) {
+		bucket := openflow.Bucket{Weight: bucketWeight(service, ep)}
+		if affinityEnabled(service) {
+			// pin the client to this bucket, the learned flow loads the endpoint into reg2 or xxreg2 and reg3
+			bucket.Actions = append(bucket.Actions, &openflow.Learn{
+				Table:       AffinityTable,
+				IdleTimeout: uint16(service.AffinityTimeout),
+				Priority:    100,
+				Specs:       learnEndpoint(ep),
+			})
+		}
+		bucket.Actions = append(bucket.Actions, constructNat(ep.IP, ep.Port))
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
+
+func learnEndpoint(ep endpoint) []openflow.LearnSpec {
+	// an IPv6 endpoint doesn't fit in reg2, it goes to xxreg2 (reg8 to reg11), which needs OVS 2.6
+	ethType := ipEthType(ep.IP)
+	specs := []openflow.LearnSpec{openflow.LearnMatchValue(openflow.FieldEthType, []byte{byte(ethType >> 8), byte(ethType)})}
+	if isIPv6(ep.IP) {
+		specs = append(specs, openflow.LearnMatchField(openflow.FieldIPv6Src), openflow.LearnMatchField(openflow.FieldReg(4)),
+			openflow.LearnLoadValue(net.ParseIP(ep.IP).To16(), openflow.FieldXXReg(2), 0, 128))
+	} else {
+		specs = append(specs, openflow.LearnMatchField(openflow.FieldIPv4Src), openflow.LearnMatchField(openflow.FieldReg(4)),
+			openflow.LearnLoad(ipToReg(ep.IP), openflow.FieldReg(2), 0, 32))
+	}
+	return append(specs, openflow.LearnLoad(uint32(ep.Port), openflow.FieldReg(3), 0, 16))
+}
+
+func constructGroup(service K8ssvc, pg portGroup, command uint16) *openflow.GroupMod {
+	// every service port has its own group, its buckets DNAT to the endpoint port of the same name
+	return &openflow.GroupMod{Command: command, Type: openflow.GroupTypeSelect, GroupID: uint32(service.OvsGroups[pg.name()]),
+		Buckets: constructBuckets(service, pg)}
+}
+
+func constructFlowMatch(ip string, protocol api.Protocol, port int32) openflow.Match {
+	// match for a service flow on a single ip and port, ports of unknown protocols never get here
+	proto := ipProto(protocol)
+	return openflow.Match{openflow.EthType(ipEthType(ip)), openflow.IPDst(net.ParseIP(ip)),
+		openflow.IPProto(proto), openflow.L4Dst(proto, uint16(port))}
+}
+
+func getNodeIPs() []string {
+	// collect the addresses of all local interfaces except loopback and IPv6 link-local
+	var nodeIPs []string
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		Error.Printf("could not retrieve the local interface addresses: %s", err)
+		return nodeIPs
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		nodeIPs = append(nodeIPs, ipnet.IP.String())
+	}
+	return nodeIPs
+}
+
+func affinityEnabled(service K8ssvc) bool {
+	// both families learn the endpoint, IPv4 into reg2 and IPv6 into xxreg2
+	return service.SessionAffinity == api.ServiceAffinityClientIP
+}
+
+func groupActions(service K8ssvc, pg portGroup) []openflow.Action {
+	// services with ClientIP affinity look up a learned endpoint first and fall back to the group
+	group := uint32(service.OvsGroups[pg.name()])
+	if affinityEnabled(service) {
+		return []openflow.Action{&openflow.SetField{Field: openflow.Reg(4, group)},
+			&openflow.Resubmit{Table: AffinityTable}, &openflow.Resubmit{Table: AffinityNatTable}}
+	}
+	return []openflow.Action{&openflow.Group{GroupID: group}}
+}
+
+func affinityNatMatch(group int, ep endpoint) openflow.Match {
+	// matches what the learned flow of the endpoint loaded, see learnEndpoint
+	endpointReg := openflow.Reg(2, ipToReg(ep.IP))
+	if isIPv6(ep.IP) {
+		endpointReg = openflow.XXReg(2, net.ParseIP(ep.IP))
+	}
+	return openflow.Match{openflow.EthType(ipEthType(ep.IP)), openflow.Reg(4, uint32(group)),
+		endpointReg, openflow.RegMasked(3, uint32(ep.Port), 0xffff)}
+}
+
+func affinityFlows(service K8ssvc, pg portGroup) []openflow.Message {
+	if !affinityEnabled(service) {
+		return nil
+	}
+	group := service.OvsGroups[pg.name()]
+	ethType := openflow.EthTypeIPv4
+	if pg.IPv6 {
+		ethType = openflow.EthTypeIPv6
+	}
+	msgs := []openflow.Message{addFlow(AffinityNatTable, 90,
+		openflow.Match{openflow.EthType(ethType), openflow.Reg(4, uint32(group))},
+		&openflow.Group{GroupID: uint32(group)})}
+	for _, ep := range portEndpoints(service, pg) {
+		msgs = append(msgs, addFlow(AffinityNatTable, 100, affinityNatMatch(group, ep), constructNat(ep.IP, ep.Port)))
+	}
+	return msgs
+}
+
+func delAffinityFlows(group int) []openflow.Message {
+	// removes the learned entries as well, they all match on the group id in reg4
+	reg := openflow.Reg(4, uint32(group))
+	return []openflow.Message{delFlows(AffinityTable, openflow.Match{reg}), delFlows(AffinityNatTable, openflow.Match{reg})}
+}
+
+func updAffinityFlows(currentService K8ssvc, modifiedService K8ssvc, currentPG portGroup, modifiedPG portGroup) []openflow.Message {
+	// flows of remaining endpoints are replaced in place, only the ones of vanished endpoints are deleted.
+	// Learned entries are kept, the ones pointing to a vanished endpoint fall back to the group
+	if !affinityEnabled(modifiedService) {
+		return nil
+	}
+	msgs := affinityFlows(modifiedService, modifiedPG)
+	remaining := make(map[endpoint]bool)
+	for _, ep := range portEndpoints(modifiedService, modifiedPG) {
+		remaining[ep] = true
+	}
+	for _, ep := range portEndpoints(currentService, currentPG) {
+		if !remaining[ep] {
+			msgs = append(msgs, delFlows(AffinityNatTable, affinityNatMatch(modifiedService.OvsGroups[modifiedPG.name()], ep)))
+		}
+	}
+	return msgs
+}
+
+func serviceIPs(service K8ssvc) []string {
+	// all addresses the service ports are reachable on, NodePorts are handled separately
+	ips := append([]string{}, service.ClusterIPs...)
+	ips = append(ips, service.ExternalIPs...)
+	return append(ips, service.IngressIPs...)
+}
+
+func ovsFlows(service K8ssvc, ips []string, ports []api.ServicePort) []openflow.Message {
+	var msgs []openflow.Message
+	for _, ip := range ips {
+		for _, port := range ports {
+			// the port is translated to the targetPort by the NAT of the group
+			msgs = append(msgs, addFlow(ServiceTable, 100, constructFlowMatch(ip, port.Protocol, port.Port),
+				groupActions(service, trafficGroup(service, port, ip, !stringInSlice(ip, service.ClusterIPs)))...))
+		}
+	}
+	return msgs
+}
+
+func delOvsFlows(service K8ssvc, ips []string, ports []api.ServicePort) []openflow.Message {
+	var msgs []openflow.Message
+	for _, ip := range ips {
+		for _, port := range ports {
+			msgs = append(msgs, delFlows(ServiceTable, constructFlowMatch(ip, port.Protocol, port.Port)))
+		}
+	}
+	return msgs
+}
+
+func nodePortFlows(service K8ssvc, ports []api.ServicePort) []openflow.Message {
+	var msgs []openflow.Message
+	for _, port := range ports {
+		if port.NodePort == 0 {
+			continue
+		}
+		// NodePort traffic remembers the node address in reg1, table 2 SNATs it after the DNAT of the group.
+		// Traffic to local endpoints keeps the client address, it doesn't leave the node.
+		for index, nodeIP := range NodeIPs {
+			match := append(constructFlowMatch(nodeIP, port.Protocol, port.NodePort),
+				openflow.CtState(0, openflow.CtStateTracked))
+			pg := trafficGroup(service, port, nodeIP, true)
+			var actions []openflow.Action
+			if !pg.Local {
+				actions = append(actions, &openflow.SetField{Field: openflow.Reg(1, nodeMark(index))})
+			}
+			actions = append(actions, groupActions(service, pg)...)
+			msgs = append(msgs, addFlow(ServiceTable, 100, match, actions...))
+		}
+	}
+	return msgs
+}
+
+func delNodePortFlows(service K8ssvc, ports []api.ServicePort) []openflow.Message {
+	var msgs []openflow.Message
+	for _, port := range ports {
+		if port.NodePort == 0 {
+			continue
+		}
+		for _, nodeIP := range NodeIPs {
+			msgs = append(msgs, delFlows(ServiceTable, constructFlowMatch(nodeIP, port.Protocol, port.NodePort)))
+		}
+	}
+	return msgs
+}
+
+func groupMessages(service K8ssvc, groups []portGroup, command uint16) []openflow.Message {
+	var msgs []openflow.Message
+	for _, pg := range groups {
+		msgs = append(msgs, constructGroup(service, pg, command))
+		msgs = append(msgs, affinityFlows(service, pg)...)
+	}
+	return msgs
+}
+
+func delGroupMessages(groups []int) []openflow.Message {
+	var msgs []openflow.Message
+	for _, group := range groups {
+		msgs = append(msgs, delAffinityFlows(group)...)
+		msgs = append(msgs, &openflow.GroupMod{Command: openflow.GroupDelete, GroupID: uint32(group)})
+	}
+	return msgs
+}
+
+func serviceMessages(service K8ssvc) []openflow.Message {
+	// the groups have to exist before flows can point to them
+	msgs := groupMessages(service, portGroups(service), openflow.GroupAdd)
+	msgs = append(msgs, ovsFlows(service, serviceIPs(service), service.Ports)...)
+	return append(msgs, nodePortFlows(service, service.Ports)...)
+}
+
+func addOvsSvc(service K8ssvc) error {
+	return ofexecutor(serviceMessages(service)...)
+}
+
+func resyncSvcOvs(service K8ssvc) error {
+	// programs the service again, flows are replaced in place and groups that still exist are modified
+	existing := make(map[uint32]bool)
+	if dryRun() {
+		// the groups of the service were written before
+		for _, group := range serviceGroups(service) {
+			existing[uint32(group)] = true
+		}
+	} else {
+		groups, err := ofconn.DumpGroups()
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			existing[group.GroupID] = true
+		}
+	}
+	msgs := serviceMessages(service)
+	for _, msg := range msgs {
+		if group, ok := msg.(*openflow.GroupMod); ok && existing[group.GroupID] {
+			group.Command = openflow.GroupModify
+		}
+	}
+	return ofexecutor(msgs...)
+}
+
+func delSvcOvs(service K8ssvc) error {
+	// Delete Service from OVS, the flows first so nothing points to the group anymore
+	var msgs []openflow.Message
+	for _, clusterIP := range service.ClusterIPs {
+		msgs = append(msgs, delFlows(ServiceTable, openflow.Match{openflow.EthType(ipEthType(clusterIP)),
+			openflow.IPDst(net.ParseIP(clusterIP))}))
+	}
+	msgs = append(msgs, delOvsFlows(service, serviceIPs(service), service.Ports)...)
+	msgs = append(msgs, delNodePortFlows(service, service.Ports)...)
+	msgs = append(msgs, delGroupMessages(serviceGroups(service))...)
+	return ofexecutor(msgs...)
+}
+
+func natCatchFlows() []openflow.Message {
+	// the catch flow rules of each address family for CT Nat'ed established connections and the NodePort SNAT flows
+	var msgs []openflow.Message
+	for _, ethType := range []uint16{openflow.EthTypeIPv4, openflow.EthTypeIPv6} {
+		msgs = append(msgs, addFlow(ServiceTable, 90, openflow.Match{openflow.EthType(ethType)},
+			&openflow.Conntrack{Recirc: true, Table: EgressTable, Actions: []openflow.Action{&openflow.Nat{}}}))
+	}
+	for index, nodeIP := range NodeIPs {
+		// SNAT of NodePort traffic after the group DNAT, so replies come back through this node
+		snatMatch := openflow.Match{openflow.EthType(ipEthType(nodeIP)), openflow.Reg(1, nodeMark(index))}
+		msgs = append(msgs, addFlow(EgressTable, 200, snatMatch,
+			&openflow.SetField{Field: openflow.Reg(1, 0)},
+			&openflow.Conntrack{Commit: true, Zone: NodePortSnatZone, Recirc: true, Table: EgressTable,
+				Actions: []openflow.Action{&openflow.Nat{Flags: openflow.NatSrc, IP: net.ParseIP(nodeIP)}}}))
+		// replies to SNAT'ed NodePort connections are un-SNAT'ed first and then handled by the catch flow
+		msgs = append(msgs, addFlow(ServiceTable, 95,
+			openflow.Match{openflow.EthType(ipEthType(nodeIP)), openflow.IPDst(net.ParseIP(nodeIP)),
+				openflow.CtState(0, openflow.CtStateTracked)},
+			&openflow.Conntrack{Zone: NodePortSnatZone, Recirc: true, Table: ServiceTable,
+				Actions: []openflow.Action{&openflow.Nat{}}}))
+	}
+	return msgs
+}
+
+func replaceNatCatchFlows() []openflow.Message {
+	// replaces the catch flow rules and whatever service flows a previous run left behind
+	msgs := []openflow.Message{delFlows(ServiceTable, openflow.Match{openflow.EthType(openflow.EthTypeIPv4)}),
+		delFlows(ServiceTable, openflow.Match{openflow.EthType(openflow.EthTypeIPv6)})}
+	for index, nodeIP := range NodeIPs {
+		msgs = append(msgs, delFlows(EgressTable, openflow.Match{openflow.EthType(ipEthType(nodeIP)),
+			openflow.Reg(1, nodeMark(index))}))
+	}
+	return append(msgs, natCatchFlows()...)
+}
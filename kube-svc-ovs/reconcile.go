@@ -0,0 +1,169 @@
+package main
+
+import (
+	"github.com/yfauser/gocode/openflow"
+	"k8s.io/kubernetes/pkg/util/workqueue"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// result of a reconciler run, how much drift between the services and OVS was repaired
+type reconcileReport struct {
+	Time          time.Time
+	FlowsAdded    int
+	FlowsModified int
+	FlowsDeleted  int
+	GroupsAdded   int
+	GroupsChanged int
+	GroupsDeleted int
+	Err           error
+}
+
+func (r reconcileReport) drift() int {
+	return r.FlowsAdded + r.FlowsModified + r.FlowsDeleted + r.GroupsAdded + r.GroupsChanged + r.GroupsDeleted
+}
+
+// last reconciler run, written by the sync loop
+var lastReconcile reconcileReport
+
+func reconcileOnSignal(queue workqueue.Interface) {
+	// a reconcile still waiting in the queue covers further requests
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		Info.Printf("SIGHUP received, reconciling OVS")
+		queue.Add(ReconcileKey)
+	}
+}
+
+func flowKey(table uint8, priority uint16, match openflow.Match) string {
+	return strconv.Itoa(int(table)) + "," + strconv.Itoa(int(priority)) + "," + match.Key()
+}
+
+func desiredState(services []K8ssvc) (map[string]*openflow.FlowMod, map[uint32]*openflow.GroupMod) {
+	// the flows and groups the services should have in OVS, built with the same functions that program them
+	flows := make(map[string]*openflow.FlowMod)
+	groups := make(map[uint32]*openflow.GroupMod)
+	msgs := natCatchFlows()
+	for _, service := range services {
+		if !service.Deleted {
+			msgs = append(msgs, serviceMessages(service)...)
+		}
+	}
+	for _, msg := range msgs {
+		switch m := msg.(type) {
+		case *openflow.FlowMod:
+			flows[flowKey(m.Table, m.Priority, m.Match)] = m
+		case *openflow.GroupMod:
+			groups[m.GroupID] = m
+		}
+	}
+	return flows, groups
+}
+
+func reconcile(services []K8ssvc) reconcileReport {
+	// compares the desired flows and groups with the dumped ones and sends only the differences.
+	// Learned affinity entries are left alone, they don't carry the proxy cookie.
+	report := reconcileReport{Time: time.Now()}
+	desiredFlows, desiredGroups := desiredState(services)
+	actualFlows, err := ofconn.DumpFlows(openflow.TableAll, ProxyCookie, ^uint64(0))
+	if err != nil {
+		report.Err = err
+		return report
+	}
+	actualGroups, err := ofconn.DumpGroups()
+	if err != nil {
+		report.Err = err
+		return report
+	}
+
+	// groups first, flows can only point to existing groups
+	var msgs []openflow.Message
+	seenGroups := make(map[uint32]bool)
+	for _, actual := range actualGroups {
+		desired, ok := desiredGroups[actual.GroupID]
+		if !ok {
+			continue
+		}
+		seenGroups[actual.GroupID] = true
+		if actual.Type != desired.Type || !openflow.BucketsEqual(actual.Buckets, desired.Buckets) {
+			Info.Printf("Reconciler: group %d differs", actual.GroupID)
+			modify := *desired
+			modify.Command = openflow.GroupModify
+			msgs = append(msgs, &modify)
+			report.GroupsChanged++
+		}
+	}
+	for id, desired := range desiredGroups {
+		if !seenGroups[id] {
+			Info.Printf("Reconciler: group %d missing", id)
+			msgs = append(msgs, desired)
+			report.GroupsAdded++
+		}
+	}
+
+	seenFlows := make(map[string]bool)
+	var deletes []openflow.Message
+	for _, actual := range actualFlows {
+		key := flowKey(actual.Table, actual.Priority, actual.Match)
+		desired, ok := desiredFlows[key]
+		if !ok {
+			Info.Printf("Reconciler: flow %s is not wanted", actual)
+			deletes = append(deletes, &openflow.FlowMod{Command: openflow.FlowDeleteStrict, Table: actual.Table,
+				Priority: actual.Priority, Cookie: ProxyCookie, CookieMask: ^uint64(0), Match: actual.Match})
+			report.FlowsDeleted++
+			continue
+		}
+		seenFlows[key] = true
+		if !openflow.ActionsEqual(actual.Actions, desired.Actions) || actual.IdleTimeout != desired.IdleTimeout {
+			// an add replaces the flow with the same match and priority in place
+			Info.Printf("Reconciler: flow %s differs", actual)
+			msgs = append(msgs, desired)
+			report.FlowsModified++
+		}
+	}
+	for key, desired := range desiredFlows {
+		if !seenFlows[key] {
+			Info.Printf("Reconciler: flow %s missing", desired)
+			msgs = append(msgs, desired)
+			report.FlowsAdded++
+		}
+	}
+
+	// groups are deleted last, when no flow points to them anymore
+	msgs = append(msgs, deletes...)
+	for _, actual := range actualGroups {
+		if int(actual.GroupID) >= FirstOvsGroup && desiredGroups[actual.GroupID] == nil {
+			Info.Printf("Reconciler: group %d is not wanted", actual.GroupID)
+			msgs = append(msgs, delGroupMessages([]int{int(actual.GroupID)})...)
+			report.GroupsDeleted++
+		}
+	}
+	if len(msgs) > 0 {
+		report.Err = ofexecutor(msgs...)
+	}
+	return report
+}
+
+func runReconcile(services []K8ssvc) error {
+	if dryRun() {
+		// there is no OVS state to compare with
+		return nil
+	}
+	lastReconcile = reconcile(services)
+	if lastReconcile.Err != nil {
+		return lastReconcile.Err
+	}
+	observeReconcile(lastReconcile)
+	if lastReconcile.drift() == 0 {
+		Info.Printf("Reconciler: OVS is in sync")
+		return nil
+	}
+	Info.Printf("Reconciler repaired drift: flows %d added, %d modified, %d deleted, groups %d added, %d modified, %d deleted",
+		lastReconcile.FlowsAdded, lastReconcile.FlowsModified, lastReconcile.FlowsDeleted,
+		lastReconcile.GroupsAdded, lastReconcile.GroupsChanged, lastReconcile.GroupsDeleted)
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/yfauser/gocode/openflow"
+	"io/ioutil"
+	"k8s.io/kubernetes/pkg/types"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// file the service and group id state is kept in across restarts, set from the Config
+var StateFile string
+
+// stateSnapshot is the state written to StateFile. After a restart the services
+// get back their groups by UID, which also covers the groups of Local and IPv6
+// traffic that can't be recovered from the cluster IP flows.
+type stateSnapshot struct {
+	Time     time.Time
+	Services []serviceSnapshot
+}
+
+type serviceSnapshot struct {
+	Key    string
+	Uid    types.UID
+	Groups map[string]int
+}
+
+func snapshotKey(uid types.UID, pgName string) string {
+	// the key of a snapshot group in the recovered ids of the allocator, '#' is in no group key
+	return "#" + string(uid) + "/" + pgName
+}
+
+func writeSnapshot(path string, services []K8ssvc) error {
+	// written to a temporary file first, a crash never leaves a truncated snapshot
+	snapshot := stateSnapshot{Time: time.Now()}
+	for _, service := range services {
+		if !service.Deleted {
+			snapshot.Services = append(snapshot.Services, serviceSnapshot{
+				Key: serviceKey(service.Namespace, service.Name), Uid: service.Uid, Groups: service.OvsGroups})
+		}
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readSnapshot(path string) (*stateSnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot stateSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func (a *groupAllocator) restore(snapshot *stateSnapshot) {
+	// groups of the snapshot that still exist in OVS are handed back to their service
+	restored := 0
+	for _, service := range snapshot.Services {
+		for pgName, id := range service.Groups {
+			if a.existing[id] {
+				a.recovered[snapshotKey(service.Uid, pgName)] = id
+				restored++
+			}
+		}
+	}
+	Info.Printf("Restored %d group ids of %d services from the snapshot of %s", restored,
+		len(snapshot.Services), snapshot.Time)
+}
+
+func saveState(services []K8ssvc) {
+	if StateFile == "" || dryRun() {
+		return
+	}
+	if err := writeSnapshot(StateFile, services); err != nil {
+		Error.Printf("could not write the state snapshot %s: %s", StateFile, err)
+	}
+}
+
+func cleanup() error {
+	// removes every flow and group the proxy owns, the flows of the OVS plugin have no proxy cookie.
+	// The learned affinity entries don't carry the cookie either, their table belongs to the proxy.
+	msgs := []openflow.Message{
+		&openflow.FlowMod{Command: openflow.FlowDelete, Table: openflow.TableAll, Cookie: ProxyCookie,
+			CookieMask: ^uint64(0)},
+		delFlows(AffinityTable, openflow.Match{}),
+	}
+	groups, err := ofconn.DumpGroups()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if int(group.GroupID) >= FirstOvsGroup {
+			msgs = append(msgs, &openflow.GroupMod{Command: openflow.GroupDelete, GroupID: group.GroupID})
+		}
+	}
+	if err := ofexecutor(msgs...); err != nil {
+		return err
+	}
+	Info.Printf("Removed all flows and %d groups of the proxy", len(msgs)-2)
+	for _, path := range []string{StateFile, DebugSocket} {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"os"
+)
+
+// the 1.3 API has no traffic policy fields, Services opt in with annotations
+const (
+	ExternalTrafficAnnotation string = "kube-svc-ovs/external-traffic-policy"
+	InternalTrafficAnnotation string = "kube-svc-ovs/internal-traffic-policy"
+	TopologyAwareAnnotation   string = "kube-svc-ovs/topology-aware"
+	TrafficPolicyLocal        string = "Local"
+)
+
+// bucket weights of endpoints in and outside of the zone of this node, set from the Config
+var (
+	SameZoneWeight  uint16
+	OtherZoneWeight uint16
+)
+
+// name of the node the proxy runs on, endpoints on it are local
+var NodeName string
+
+func getNodeName() string {
+	// like kube-proxy the node name defaults to the hostname
+	if name := os.Getenv("NODE_NAME"); name != "" {
+		return name
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		Error.Printf("could not determine the node name: %s", err)
+	}
+	return name
+}
+
+// endpointTopology is where an endpoint runs relative to this node
+type endpointTopology struct {
+	Local    bool
+	SameZone bool
+}
+
+// portGroup is a group of a service port. Local groups only hold the endpoints on
+// this node, IPv6 groups the IPv6 endpoints, NAT can't translate between families.
+type portGroup struct {
+	Port  api.ServicePort
+	Local bool
+	IPv6  bool
+}
+
+func (pg portGroup) name() string {
+	// key of the group in K8ssvc.OvsGroups, port names can't contain a '/'
+	name := pg.Port.Name
+	if pg.Local {
+		name += "/local"
+	}
+	if pg.IPv6 {
+		name += "/v6"
+	}
+	return name
+}
+
+func serviceFamilies(service K8ssvc) []bool {
+	// the address families traffic of the service can arrive with, true is IPv6
+	var v4, v6 bool
+	ips := serviceIPs(service)
+	for _, port := range service.Ports {
+		if port.NodePort != 0 {
+			ips = append(ips, NodeIPs...)
+			break
+		}
+	}
+	for _, ip := range ips {
+		if isIPv6(ip) {
+			v6 = true
+		} else {
+			v4 = true
+		}
+	}
+	var families []bool
+	if v4 {
+		families = append(families, false)
+	}
+	if v6 {
+		families = append(families, true)
+	}
+	return families
+}
+
+func portGroups(service K8ssvc) []portGroup {
+	// a port needs a second group if internal and external traffic have different policies,
+	// and one of each for every address family
+	var groups []portGroup
+	for _, port := range service.Ports {
+		for _, v6 := range serviceFamilies(service) {
+			groups = append(groups, portGroup{Port: port, Local: service.InternalLocal, IPv6: v6})
+			if service.ExternalLocal != service.InternalLocal {
+				groups = append(groups, portGroup{Port: port, Local: service.ExternalLocal, IPv6: v6})
+			}
+		}
+	}
+	return groups
+}
+
+func trafficGroup(service K8ssvc, port api.ServicePort, ip string, external bool) portGroup {
+	// the group flows of the port on ip point to, external traffic comes in on external IPs,
+	// LoadBalancer ingress IPs and NodePorts
+	if external {
+		return portGroup{Port: port, Local: service.ExternalLocal, IPv6: isIPv6(ip)}
+	}
+	return portGroup{Port: port, Local: service.InternalLocal, IPv6: isIPv6(ip)}
+}
+
+func bucketWeight(service K8ssvc, ep endpoint) uint16 {
+	if !service.TopologyAware || service.Topology[ep.IP].SameZone {
+		return SameZoneWeight
+	}
+	return OtherZoneWeight
+}
+
+func (c *serviceController) nodeZone(name string) string {
+	obj, exists, err := c.nodeStore.GetByKey(name)
+	if err != nil || !exists {
+		return ""
+	}
+	return obj.(*api.Node).Labels[unversioned.LabelZoneFailureDomain]
+}
+
+func (c *serviceController) endpointTopology(subsets []api.EndpointSubset) map[string]endpointTopology {
+	// the 1.3 Endpoints don't carry a node name, it comes from the pods they refer to.
+	// Endpoints without a pod are neither local nor in the same zone.
+	topology := make(map[string]endpointTopology)
+	zone := c.nodeZone(NodeName)
+	for _, subset := range subsets {
+		for _, addr := range subset.Addresses {
+			if addr.TargetRef == nil || addr.TargetRef.Kind != "Pod" {
+				continue
+			}
+			obj, exists, err := c.podStore.GetByKey(addr.TargetRef.Namespace + "/" + addr.TargetRef.Name)
+			if err != nil || !exists {
+				continue
+			}
+			node := obj.(*api.Pod).Spec.NodeName
+			topology[addr.IP] = endpointTopology{
+				Local:    node == NodeName,
+				SameZone: zone != "" && c.nodeZone(node) == zone,
+			}
+		}
+	}
+	return topology
+}
@@ -0,0 +1,464 @@
+package openflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Action is an OpenFlow action, Nicira extension actions included
+type Action interface {
+	marshal() []byte
+	String() string
+}
+
+const (
+	actionOutput       uint16 = 0
+	actionGroup        uint16 = 22
+	actionSetField     uint16 = 25
+	actionExperimenter uint16 = 0xffff
+
+	nxVendorID         uint32 = 0x00002320
+	nxResubmitTable    uint16 = 14
+	nxLearn            uint16 = 16
+	nxConntrack        uint16 = 35
+	nxNat              uint16 = 36
+	nxResubmitInPort   uint16 = 0xfff8
+	nxCtRecircNone     uint8  = 0xff
+	nxCtFlagCommit     uint16 = 1 << 0
+	nxNatRangeIPv4Min  uint16 = 1 << 0
+	nxNatRangeIPv6Min  uint16 = 1 << 2
+	nxNatRangeProtoMin uint16 = 1 << 4
+)
+
+// NAT flags
+const (
+	NatSrc uint16 = 1 << 0
+	NatDst uint16 = 1 << 1
+)
+
+// Output sends the packet to a port
+type Output struct {
+	Port uint32
+}
+
+func (a *Output) marshal() []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint16(b, actionOutput)
+	binary.BigEndian.PutUint16(b[2:], 16)
+	binary.BigEndian.PutUint32(b[4:], a.Port)
+	return b
+}
+
+func (a *Output) String() string {
+	return "output:" + strconv.FormatUint(uint64(a.Port), 10)
+}
+
+// Group passes the packet to a group
+type Group struct {
+	GroupID uint32
+}
+
+func (a *Group) marshal() []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b, actionGroup)
+	binary.BigEndian.PutUint16(b[2:], 8)
+	binary.BigEndian.PutUint32(b[4:], a.GroupID)
+	return b
+}
+
+func (a *Group) String() string {
+	return "group:" + strconv.FormatUint(uint64(a.GroupID), 10)
+}
+
+// SetField writes the value of the match field into the packet or register
+type SetField struct {
+	Field MatchField
+}
+
+func (a *SetField) marshal() []byte {
+	length := pad8(4 + a.Field.len())
+	b := make([]byte, length)
+	binary.BigEndian.PutUint16(b, actionSetField)
+	binary.BigEndian.PutUint16(b[2:], uint16(length))
+	a.Field.marshal(b[4:])
+	return b
+}
+
+func (a *SetField) String() string {
+	return "set_field:" + a.Field.valueString() + "->" + a.Field.Field.name()
+}
+
+func nxHeader(subtype uint16, length int) []byte {
+	b := make([]byte, length)
+	binary.BigEndian.PutUint16(b, actionExperimenter)
+	binary.BigEndian.PutUint16(b[2:], uint16(length))
+	binary.BigEndian.PutUint32(b[4:], nxVendorID)
+	binary.BigEndian.PutUint16(b[8:], subtype)
+	return b
+}
+
+// Resubmit looks the packet up in another table and continues with the actions
+type Resubmit struct {
+	Table uint8
+}
+
+func (a *Resubmit) marshal() []byte {
+	b := nxHeader(nxResubmitTable, 16)
+	binary.BigEndian.PutUint16(b[10:], nxResubmitInPort)
+	b[12] = a.Table
+	return b
+}
+
+func (a *Resubmit) String() string {
+	return "resubmit(," + strconv.Itoa(int(a.Table)) + ")"
+}
+
+// Conntrack sends the packet through the connection tracker, Table is the
+// table the packet is recirculated to after the nested actions ran
+type Conntrack struct {
+	Commit  bool
+	Zone    uint16
+	Table   uint8
+	Recirc  bool
+	Actions []Action
+}
+
+func (a *Conntrack) marshal() []byte {
+	nested := marshalActions(a.Actions)
+	b := nxHeader(nxConntrack, 24+len(nested))
+	if a.Commit {
+		binary.BigEndian.PutUint16(b[10:], nxCtFlagCommit)
+	}
+	binary.BigEndian.PutUint16(b[16:], a.Zone)
+	b[18] = nxCtRecircNone
+	if a.Recirc {
+		b[18] = a.Table
+	}
+	copy(b[24:], nested)
+	return b
+}
+
+func (a *Conntrack) String() string {
+	var args []string
+	if a.Commit {
+		args = append(args, "commit")
+	}
+	if a.Zone != 0 {
+		args = append(args, "zone="+strconv.Itoa(int(a.Zone)))
+	}
+	for _, action := range a.Actions {
+		args = append(args, action.String())
+	}
+	if a.Recirc {
+		args = append(args, "table="+strconv.Itoa(int(a.Table)))
+	}
+	return "ct(" + strings.Join(args, ",") + ")"
+}
+
+// Nat is only valid inside a Conntrack action, without an address it applies
+// the existing NAT binding of the connection
+type Nat struct {
+	Flags uint16
+	IP    net.IP
+	Port  uint16
+}
+
+func (a *Nat) marshal() []byte {
+	var params []byte
+	var rangePresent uint16
+	if ipv4 := a.IP.To4(); ipv4 != nil {
+		rangePresent |= nxNatRangeIPv4Min
+		params = append(params, ipv4...)
+	} else if a.IP != nil {
+		rangePresent |= nxNatRangeIPv6Min
+		params = append(params, a.IP.To16()...)
+	}
+	if a.Port != 0 {
+		rangePresent |= nxNatRangeProtoMin
+		params = append(params, uint16Bytes(a.Port)...)
+	}
+	b := nxHeader(nxNat, pad8(16+len(params)))
+	binary.BigEndian.PutUint16(b[12:], a.Flags)
+	binary.BigEndian.PutUint16(b[14:], rangePresent)
+	copy(b[16:], params)
+	return b
+}
+
+func (a *Nat) String() string {
+	if a.IP == nil {
+		return "nat"
+	}
+	direction := "dst="
+	if a.Flags&NatSrc != 0 {
+		direction = "src="
+	}
+	address := a.IP.String()
+	if a.IP.To4() == nil {
+		address = "[" + address + "]"
+	}
+	if a.Port != 0 {
+		address += ":" + strconv.Itoa(int(a.Port))
+	}
+	return "nat(" + direction + address + ")"
+}
+
+// LearnSpec is a single match or load of a flow installed by a Learn action.
+// Without SrcField the Value is used as immediate.
+type LearnSpec struct {
+	Load     bool
+	SrcField *Field
+	Value    []byte
+	Dst      Field
+	Ofs      uint16
+	Bits     uint16
+}
+
+// LearnMatchField matches the learned flow on the current value of the field
+func LearnMatchField(field Field) LearnSpec {
+	return LearnSpec{SrcField: &field, Dst: field, Bits: uint16(field.Len) * 8}
+}
+
+// LearnMatchValue matches the learned flow on an immediate value
+func LearnMatchValue(field Field, value []byte) LearnSpec {
+	return LearnSpec{Value: value, Dst: field, Bits: uint16(field.Len) * 8}
+}
+
+// LearnLoad loads an immediate value into bits of a field when the learned flow matches
+func LearnLoad(value uint32, field Field, ofs uint16, bits uint16) LearnSpec {
+	return LearnSpec{Load: true, Value: uint32Bytes(value), Dst: field, Ofs: ofs, Bits: bits}
+}
+
+// LearnLoadValue loads an immediate value of any length, like an IPv6 address
+// into an xxreg, when the learned flow matches
+func LearnLoadValue(value []byte, field Field, ofs uint16, bits uint16) LearnSpec {
+	return LearnSpec{Load: true, Value: value, Dst: field, Ofs: ofs, Bits: bits}
+}
+
+func (s LearnSpec) immediate() []byte {
+	// immediates are right aligned in a multiple of 16 bits
+	n := int(s.Bits+15) / 16 * 2
+	b := make([]byte, n)
+	if len(s.Value) >= n {
+		copy(b, s.Value[len(s.Value)-n:])
+	} else {
+		copy(b[n-len(s.Value):], s.Value)
+	}
+	return b
+}
+
+func (s LearnSpec) marshal() []byte {
+	header := s.Bits
+	if s.SrcField == nil {
+		header |= 1 << 13
+	}
+	if s.Load {
+		header |= 1 << 11
+	}
+	b := uint16Bytes(header)
+	if s.SrcField != nil {
+		b = append(b, uint32Bytes(s.SrcField.learnHeader())...)
+		b = append(b, uint16Bytes(s.Ofs)...)
+	} else {
+		b = append(b, s.immediate()...)
+	}
+	b = append(b, uint32Bytes(s.Dst.learnHeader())...)
+	return append(b, uint16Bytes(s.Ofs)...)
+}
+
+func (s LearnSpec) subfield() string {
+	if s.Ofs == 0 && s.Bits == uint16(s.Dst.Len)*8 {
+		return s.Dst.subfieldName() + "[]"
+	}
+	return fmt.Sprintf("%s[%d..%d]", s.Dst.subfieldName(), s.Ofs, s.Ofs+s.Bits-1)
+}
+
+func (s LearnSpec) String() string {
+	if s.Load {
+		return "load:" + hexValue(s.immediate()) + "->" + s.subfield()
+	}
+	if s.SrcField == nil {
+		return s.Dst.name() + "=" + formatFieldValue(s.Dst, s.immediate()[len(s.immediate())-int(s.Dst.Len):])
+	}
+	return s.subfield()
+}
+
+// Learn adds or refreshes a flow built from the specs in another table
+type Learn struct {
+	Table       uint8
+	IdleTimeout uint16
+	HardTimeout uint16
+	Priority    uint16
+	Cookie      uint64
+	Specs       []LearnSpec
+}
+
+func (a *Learn) marshal() []byte {
+	var specs []byte
+	for _, spec := range a.Specs {
+		specs = append(specs, spec.marshal()...)
+	}
+	b := nxHeader(nxLearn, pad8(32+len(specs)))
+	binary.BigEndian.PutUint16(b[10:], a.IdleTimeout)
+	binary.BigEndian.PutUint16(b[12:], a.HardTimeout)
+	binary.BigEndian.PutUint16(b[14:], a.Priority)
+	binary.BigEndian.PutUint64(b[16:], a.Cookie)
+	b[26] = a.Table
+	copy(b[32:], specs)
+	return b
+}
+
+func (a *Learn) String() string {
+	args := []string{"table=" + strconv.Itoa(int(a.Table))}
+	if a.IdleTimeout != 0 {
+		args = append(args, "idle_timeout="+strconv.Itoa(int(a.IdleTimeout)))
+	}
+	if a.HardTimeout != 0 {
+		args = append(args, "hard_timeout="+strconv.Itoa(int(a.HardTimeout)))
+	}
+	args = append(args, "priority="+strconv.Itoa(int(a.Priority)))
+	if a.Cookie != 0 {
+		args = append(args, fmt.Sprintf("cookie=0x%x", a.Cookie))
+	}
+	for _, spec := range a.Specs {
+		args = append(args, spec.String())
+	}
+	return "learn(" + strings.Join(args, ",") + ")"
+}
+
+// RawAction is an action this package can't decode, it is kept as is
+type RawAction struct {
+	Data []byte
+}
+
+func (a *RawAction) marshal() []byte {
+	return a.Data
+}
+
+func (a *RawAction) String() string {
+	return fmt.Sprintf("raw(%x)", a.Data)
+}
+
+func marshalActions(actions []Action) []byte {
+	var b []byte
+	for _, action := range actions {
+		b = append(b, action.marshal()...)
+	}
+	return b
+}
+
+// ActionsString returns the actions in ovs-ofctl syntax, "drop" for none
+func ActionsString(actions []Action) string {
+	if len(actions) == 0 {
+		return "drop"
+	}
+	parts := make([]string, len(actions))
+	for i, action := range actions {
+		parts[i] = action.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// ActionsEqual compares the wire encoding of two action lists
+func ActionsEqual(a []Action, b []Action) bool {
+	return string(marshalActions(a)) == string(marshalActions(b))
+}
+
+func unmarshalActions(b []byte) ([]Action, error) {
+	var actions []Action
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("openflow: truncated action")
+		}
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		if length < 8 || length > len(b) {
+			return nil, fmt.Errorf("openflow: invalid action length %d", length)
+		}
+		action, err := unmarshalAction(b[:length])
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+		b = b[length:]
+	}
+	return actions, nil
+}
+
+func unmarshalAction(b []byte) (Action, error) {
+	raw := &RawAction{Data: append([]byte{}, b...)}
+	switch binary.BigEndian.Uint16(b) {
+	case actionOutput:
+		if len(b) < 16 {
+			return raw, nil
+		}
+		return &Output{Port: binary.BigEndian.Uint32(b[4:])}, nil
+	case actionGroup:
+		return &Group{GroupID: binary.BigEndian.Uint32(b[4:])}, nil
+	case actionSetField:
+		field, _, err := unmarshalMatchField(b[4:])
+		if err != nil {
+			return raw, nil
+		}
+		return &SetField{Field: field}, nil
+	case actionExperimenter:
+		if len(b) < 10 || binary.BigEndian.Uint32(b[4:]) != nxVendorID {
+			return raw, nil
+		}
+		return unmarshalNxAction(b, raw)
+	}
+	return raw, nil
+}
+
+func unmarshalNxAction(b []byte, raw *RawAction) (Action, error) {
+	switch binary.BigEndian.Uint16(b[8:]) {
+	case nxResubmitTable:
+		if len(b) < 16 || binary.BigEndian.Uint16(b[10:]) != nxResubmitInPort {
+			return raw, nil
+		}
+		return &Resubmit{Table: b[12]}, nil
+	case nxConntrack:
+		if len(b) < 24 || binary.BigEndian.Uint32(b[12:]) != 0 {
+			return raw, nil
+		}
+		nested, err := unmarshalActions(b[24:])
+		if err != nil {
+			return nil, err
+		}
+		ct := &Conntrack{
+			Commit:  binary.BigEndian.Uint16(b[10:])&nxCtFlagCommit != 0,
+			Zone:    binary.BigEndian.Uint16(b[16:]),
+			Actions: nested,
+		}
+		if b[18] != nxCtRecircNone {
+			ct.Recirc = true
+			ct.Table = b[18]
+		}
+		return ct, nil
+	case nxNat:
+		if len(b) < 16 {
+			return raw, nil
+		}
+		nat := &Nat{Flags: binary.BigEndian.Uint16(b[12:])}
+		rangePresent := binary.BigEndian.Uint16(b[14:])
+		params := b[16:]
+		if rangePresent&^(nxNatRangeIPv4Min|nxNatRangeIPv6Min|nxNatRangeProtoMin) != 0 {
+			return raw, nil
+		}
+		if rangePresent&nxNatRangeIPv4Min != 0 && len(params) >= 4 {
+			nat.IP = net.IP(append([]byte{}, params[:4]...))
+			params = params[4:]
+		}
+		if rangePresent&nxNatRangeIPv6Min != 0 && len(params) >= 16 {
+			nat.IP = net.IP(append([]byte{}, params[:16]...))
+			params = params[16:]
+		}
+		if rangePresent&nxNatRangeProtoMin != 0 && len(params) >= 2 {
+			nat.Port = binary.BigEndian.Uint16(params)
+		}
+		return nat, nil
+	}
+	// learn actions and others are compared in their wire format
+	return raw, nil
+}
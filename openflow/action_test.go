@@ -0,0 +1,148 @@
+package openflow
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatalf("invalid hex %q: %s", s, err)
+	}
+	return b
+}
+
+func affinityLearn() *Learn {
+	return &Learn{
+		Table:       10,
+		IdleTimeout: 10800,
+		Priority:    100,
+		Cookie:      0x4b535643,
+		Specs: []LearnSpec{
+			LearnMatchValue(FieldEthType, []byte{0x08, 0x00}),
+			LearnMatchField(FieldIPv4Src),
+			LearnMatchField(FieldReg(4)),
+			LearnLoad(0x0a000001, FieldReg(2), 0, 32),
+			LearnLoad(80, FieldReg(3), 0, 16),
+		},
+	}
+}
+
+// the learn action of a group bucket as dumped by OVS, the fields that have
+// one carry their NXM header
+const dumpedLearn = "ffff 0060 00002320 0010 2a30 0000 0064 000000004b535643 0000 0a 00 0000 0000" +
+	"2010 0800 00000602 0000" +
+	"0020 00000e04 0000 00000e04 0000" +
+	"0020 00010804 0000 00010804 0000" +
+	"2820 0a000001 00010404 0000" +
+	"2810 0050 00010604 0000" +
+	"0000 0000"
+
+func TestLearnMarshal(t *testing.T) {
+	want := decodeHex(t, dumpedLearn)
+	if got := affinityLearn().marshal(); string(got) != string(want) {
+		t.Errorf("learn encoded as\n%x\nwant\n%x", got, want)
+	}
+}
+
+func TestLearnEqualsDumped(t *testing.T) {
+	actions, err := unmarshalActions(decodeHex(t, dumpedLearn))
+	if err != nil {
+		t.Fatalf("could not decode the dumped learn action: %s", err)
+	}
+	dumped := []Bucket{{Weight: 100, Actions: actions}}
+	programmed := []Bucket{{Weight: 100, Actions: []Action{affinityLearn()}}}
+	if !BucketsEqual(dumped, programmed) {
+		t.Errorf("dumped bucket %s differs from the programmed %s", dumped[0].String(), programmed[0].String())
+	}
+}
+
+func TestLearnString(t *testing.T) {
+	want := "learn(table=10,idle_timeout=10800,priority=100,cookie=0x4b535643,dl_type=0x0800," +
+		"NXM_OF_IP_SRC[],NXM_NX_REG4[],load:0xa000001->NXM_NX_REG2[],load:0x50->NXM_NX_REG3[0..15])"
+	if got := affinityLearn().String(); got != want {
+		t.Errorf("learn formatted as\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLearnIPv6(t *testing.T) {
+	// the endpoint address doesn't fit in reg2, it's loaded into the 128 bits of xxreg2
+	learn := &Learn{
+		Table:       10,
+		IdleTimeout: 10800,
+		Priority:    100,
+		Cookie:      0x4b535643,
+		Specs: []LearnSpec{
+			LearnMatchValue(FieldEthType, []byte{0x86, 0xdd}),
+			LearnMatchField(FieldIPv6Src),
+			LearnMatchField(FieldReg(4)),
+			LearnLoadValue(net.ParseIP("fd00::1"), FieldXXReg(2), 0, 128),
+			LearnLoad(80, FieldReg(3), 0, 16),
+		},
+	}
+	want := decodeHex(t, "ffff 0068 00002320 0010 2a30 0000 0064 000000004b535643 0000 0a 00 0000 0000"+
+		"2010 86dd 00000602 0000"+
+		"0080 00012610 0000 00012610 0000"+
+		"0020 00010804 0000 00010804 0000"+
+		"2880 fd000000000000000000000000000001 0001e210 0000"+
+		"2810 0050 00010604 0000")
+	if got := learn.marshal(); string(got) != string(want) {
+		t.Errorf("learn encoded as\n%x\nwant\n%x", got, want)
+	}
+	wantString := "learn(table=10,idle_timeout=10800,priority=100,cookie=0x4b535643,dl_type=0x86dd," +
+		"NXM_NX_IPV6_SRC[],NXM_NX_REG4[],load:0xfd000000000000000000000000000001->NXM_NX_XXREG2[]," +
+		"load:0x50->NXM_NX_REG3[0..15])"
+	if got := learn.String(); got != wantString {
+		t.Errorf("learn formatted as\n%s\nwant\n%s", got, wantString)
+	}
+}
+
+func TestActionMarshal(t *testing.T) {
+	nat := &Nat{Flags: NatDst, IP: net.ParseIP("10.0.0.1"), Port: 8080}
+	for _, test := range []struct {
+		action Action
+		want   string
+	}{
+		{&Output{Port: 3}, "0000 0010 00000003 0000 000000000000"},
+		{&Group{GroupID: 100}, "0016 0008 00000064"},
+		{&SetField{Field: Reg(1, 5)}, "0019 0010 00010204 00000005 00000000"},
+		{&SetField{Field: IPSrc(net.ParseIP("10.0.0.1"))}, "0019 0010 80001604 0a000001 00000000"},
+		{&Resubmit{Table: 2}, "ffff 0010 00002320 000e fff8 02 000000"},
+		{nat, "ffff 0018 00002320 0024 0000 0002 0011 0a000001 1f90 0000"},
+		{&Nat{Flags: NatDst, IP: net.ParseIP("fd00::1"), Port: 80},
+			"ffff 0028 00002320 0024 0000 0002 0014 fd000000000000000000000000000001 0050 000000000000"},
+		{&Nat{}, "ffff 0010 00002320 0024 0000 0000 0000"},
+		{&Conntrack{Zone: 5}, "ffff 0018 00002320 0023 0000 00000000 0005 ff 000000 0000"},
+		{&Conntrack{Commit: true, Recirc: true, Table: 2, Actions: []Action{nat}},
+			"ffff 0030 00002320 0023 0001 00000000 0000 02 000000 0000" +
+				"ffff 0018 00002320 0024 0000 0002 0011 0a000001 1f90 0000"},
+	} {
+		if got, want := test.action.marshal(), decodeHex(t, test.want); string(got) != string(want) {
+			t.Errorf("%s encoded as\n%x\nwant\n%x", test.action, got, want)
+		}
+	}
+}
+
+func TestActionRoundTrip(t *testing.T) {
+	actions := []Action{
+		&SetField{Field: Reg(1, 5)},
+		&Resubmit{Table: 2},
+		&Conntrack{Commit: true, Zone: 7, Recirc: true, Table: 2,
+			Actions: []Action{&Nat{Flags: NatSrc, IP: net.ParseIP("fd00::1"), Port: 80}}},
+		&Conntrack{Actions: []Action{&Nat{}}},
+		&Group{GroupID: 100},
+		&Output{Port: 3},
+		affinityLearn(),
+	}
+	decoded, err := unmarshalActions(marshalActions(actions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ActionsEqual(decoded, actions) || ActionsString(decoded) != ActionsString(actions[:len(actions)-1])+",raw("+
+		hex.EncodeToString(affinityLearn().marshal())+")" {
+		t.Errorf("actions decoded as\n%s\nwant\n%s", ActionsString(decoded), ActionsString(actions))
+	}
+}
@@ -0,0 +1,157 @@
+package openflow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// OpenFlow 1.3 has no bundles, OVS implements them as the ONF extension 230
+const (
+	onfExperimenterID uint32 = 0x4f4e4600
+	onfBundleControl  uint32 = 2300
+	onfBundleAdd      uint32 = 2301
+)
+
+// bundle control types
+const (
+	bundleOpenRequest    uint16 = 0
+	bundleOpenReply      uint16 = 1
+	bundleCommitRequest  uint16 = 4
+	bundleCommitReply    uint16 = 5
+	bundleDiscardRequest uint16 = 6
+	bundleDiscardReply   uint16 = 7
+)
+
+// bundle flags
+const (
+	BundleAtomic  uint16 = 1
+	BundleOrdered uint16 = 2
+)
+
+const (
+	errCodeBadExperimenter uint16 = 3
+	errCodeBadExpType      uint16 = 4
+)
+
+// ErrBundlesUnsupported is returned by SendBundle if the switch doesn't know the bundle extension
+var ErrBundlesUnsupported = errors.New("openflow: switch does not support bundles")
+
+func experimenterBody(expType uint32, body []byte) []byte {
+	b := make([]byte, 8+len(body))
+	binary.BigEndian.PutUint32(b, onfExperimenterID)
+	binary.BigEndian.PutUint32(b[4:], expType)
+	copy(b[8:], body)
+	return b
+}
+
+func (c *Conn) bundleControl(bundleID uint32, ctlType uint16, flags uint16) error {
+	// sends a bundle control request and waits for the matching reply
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint32(body, bundleID)
+	binary.BigEndian.PutUint16(body[4:], ctlType)
+	binary.BigEndian.PutUint16(body[6:], flags)
+	xid := c.nextXid()
+	req := c.register(xid)
+	defer c.unregister(req, xid)
+	if err := c.write(typeExperimenter, xid, experimenterBody(onfBundleControl, body)); err != nil {
+		return err
+	}
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+	msg, err := c.wait(req, timer)
+	if err != nil {
+		return err
+	}
+	if msg.msgType == typeError {
+		return decodeError(msg.body)
+	}
+	if len(msg.body) < 16 || binary.BigEndian.Uint32(msg.body[4:]) != onfBundleControl ||
+		binary.BigEndian.Uint16(msg.body[12:]) != ctlType+1 {
+		return fmt.Errorf("openflow: unexpected reply to bundle control %d", ctlType)
+	}
+	return nil
+}
+
+// CheckBundleLength returns ErrTooLong if one of the messages doesn't fit
+// in a bundle add, which wraps it in 24 more bytes
+func CheckBundleLength(msgs ...Message) error {
+	_, err := encodeBundleAdds(0, 0, msgs, make([]uint32, len(msgs)))
+	return err
+}
+
+func encodeBundleAdds(bundleID uint32, flags uint16, msgs []Message, xids []uint32) ([][]byte, error) {
+	encoded, err := encodeMessages(msgs, xids)
+	if err != nil {
+		return nil, err
+	}
+	adds := make([][]byte, len(msgs))
+	for i := range encoded {
+		// the added message carries the xid of the bundle add message
+		add := make([]byte, 8)
+		binary.BigEndian.PutUint32(add, bundleID)
+		binary.BigEndian.PutUint16(add[6:], flags)
+		add = append(add, encoded[i]...)
+		if adds[i], err = encodeMessage(typeExperimenter, xids[i], experimenterBody(onfBundleAdd, add)); err != nil {
+			return nil, err
+		}
+	}
+	return adds, nil
+}
+
+// SendBundle transmits the messages as one atomic and ordered bundle. The
+// switch applies all of them at once or none, packets never see a state in
+// between. If one of the messages is rejected the bundle is discarded.
+func (c *Conn) SendBundle(msgs ...Message) error {
+	bundleID := c.nextXid()
+	flags := BundleAtomic | BundleOrdered
+	xids := make([]uint32, len(msgs)+1)
+	for i := range xids {
+		xids[i] = c.nextXid()
+	}
+	adds, err := encodeBundleAdds(bundleID, flags, msgs, xids)
+	if err != nil {
+		return err
+	}
+
+	if err := c.bundleControl(bundleID, bundleOpenRequest, flags); err != nil {
+		if IsError(err, ErrTypeBadRequest, errCodeBadExperimenter) || IsError(err, ErrTypeBadRequest, errCodeBadExpType) {
+			return ErrBundlesUnsupported
+		}
+		return err
+	}
+
+	// the switch checks every message when it is added, a barrier collects the errors
+	req := c.register(xids...)
+	defer c.unregister(req, xids...)
+	for _, b := range adds {
+		if err := c.writeEncoded(b); err != nil {
+			return err
+		}
+	}
+	barrierXid := xids[len(msgs)]
+	if err := c.write(typeBarrierRequest, barrierXid, nil); err != nil {
+		return err
+	}
+	var addErr error
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+	for {
+		msg, err := c.wait(req, timer)
+		if err != nil {
+			return err
+		}
+		if msg.msgType == typeError && addErr == nil {
+			addErr = decodeError(msg.body)
+		}
+		if msg.msgType == typeBarrierReply && msg.xid == barrierXid {
+			break
+		}
+	}
+	if addErr != nil {
+		c.bundleControl(bundleID, bundleDiscardRequest, flags)
+		return addErr
+	}
+	return c.bundleControl(bundleID, bundleCommitRequest, flags)
+}
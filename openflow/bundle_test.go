@@ -0,0 +1,80 @@
+package openflow
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// bundleReplies answers bundle controls and barriers, the adds of failAdd are rejected
+func bundleReplies(t *testing.T, failAdd bool) func(uint8, uint32, []byte) []*rawMessage {
+	return func(msgType uint8, xid uint32, body []byte) []*rawMessage {
+		if msgType != typeExperimenter {
+			return barrierReplies(msgType, xid, body)
+		}
+		switch binary.BigEndian.Uint32(body[4:]) {
+		case onfBundleControl:
+			reply := append([]byte{}, body...)
+			binary.BigEndian.PutUint16(reply[12:], binary.BigEndian.Uint16(body[12:])+1)
+			return []*rawMessage{{msgType: typeExperimenter, xid: xid, body: reply}}
+		case onfBundleAdd:
+			if failAdd {
+				return []*rawMessage{{msgType: typeError, xid: xid, body: decodeHex(t, "0005 0000")}}
+			}
+			return nil
+		}
+		t.Errorf("unexpected experimenter message %x", body)
+		return nil
+	}
+}
+
+func TestSendBundle(t *testing.T) {
+	c, s := newFakeSwitch(t, bundleReplies(t, false))
+	defer c.Close()
+	flow := &FlowMod{Command: FlowDelete, Table: TableAll, Cookie: 0x4b535643, CookieMask: 0xffffffffffffffff}
+	if err := c.SendBundle(flow); err != nil {
+		t.Fatal(err)
+	}
+	// bundle 1 is opened after the xids of the add and the barrier were taken
+	want := []string{
+		"0404 0018 00000004 4f4e4600 000008fc 00000001 0000 0003",
+		"0404 0050 00000002 4f4e4600 000008fd 00000001 0000 0003" +
+			"040e 0038 00000002" +
+			"000000004b535643 ffffffffffffffff ff 03 0000 0000 0000 ffffffff ffffffff ffffffff 0000 0000" +
+			"0001 0004 00000000",
+		"0414 0008 00000003",
+		"0404 0018 00000005 4f4e4600 000008fc 00000001 0004 0003",
+	}
+	received := s.messages()
+	if len(received) != len(want) {
+		t.Fatalf("switch received %d messages, want %d: %x", len(received), len(want), received)
+	}
+	for i := range want {
+		if expected := decodeHex(t, want[i]); string(received[i]) != string(expected) {
+			t.Errorf("message %d is\n%x\nwant\n%x", i, received[i], expected)
+		}
+	}
+}
+
+func TestSendBundleDiscard(t *testing.T) {
+	c, s := newFakeSwitch(t, bundleReplies(t, true))
+	defer c.Close()
+	err := c.SendBundle(&FlowMod{Command: FlowAdd, Table: 1})
+	if !IsError(err, ErrTypeFlowModFailed, 0) {
+		t.Fatalf("SendBundle returned %v, want FLOW_MOD_FAILED code 0", err)
+	}
+	received := s.messages()
+	last := received[len(received)-1]
+	if len(last) < 24 || last[1] != typeExperimenter || binary.BigEndian.Uint16(last[20:]) != bundleDiscardRequest {
+		t.Errorf("last message %x is no bundle discard", last)
+	}
+}
+
+func TestSendBundleUnsupported(t *testing.T) {
+	c, _ := newFakeSwitch(t, func(msgType uint8, xid uint32, body []byte) []*rawMessage {
+		return []*rawMessage{{msgType: typeError, xid: xid, body: decodeHex(t, "0001 0003")}}
+	})
+	defer c.Close()
+	if err := c.SendBundle(&FlowMod{Command: FlowAdd, Table: 1}); err != ErrBundlesUnsupported {
+		t.Errorf("SendBundle returned %v, want ErrBundlesUnsupported", err)
+	}
+}
@@ -0,0 +1,206 @@
+package openflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// flow-mod commands
+const (
+	FlowAdd          uint8 = 0
+	FlowModify       uint8 = 1
+	FlowModifyStrict uint8 = 2
+	FlowDelete       uint8 = 3
+	FlowDeleteStrict uint8 = 4
+)
+
+const (
+	TableAll uint8  = 0xff
+	PortAny  uint32 = 0xffffffff
+	GroupAny uint32 = 0xffffffff
+	GroupAll uint32 = 0xfffffffc
+
+	noBuffer          uint32 = 0xffffffff
+	instructionApply  uint16 = 4
+	flowModFixedLen          = 40
+	flowStatsFixedLen        = 48
+)
+
+// FlowMod adds, modifies or deletes flows. Deletes match all flows that are
+// more specific than Match unless the command is strict.
+type FlowMod struct {
+	Command     uint8
+	Table       uint8
+	Priority    uint16
+	Cookie      uint64
+	CookieMask  uint64
+	IdleTimeout uint16
+	HardTimeout uint16
+	Match       Match
+	Actions     []Action
+}
+
+func (f *FlowMod) msgType() uint8 {
+	return typeFlowMod
+}
+
+func (f *FlowMod) marshalBody() ([]byte, error) {
+	match := f.Match.marshal()
+	var instructions []byte
+	if f.Command != FlowDelete && f.Command != FlowDeleteStrict {
+		var err error
+		if instructions, err = marshalApplyActions(f.Actions); err != nil {
+			return nil, err
+		}
+	}
+	b := make([]byte, flowModFixedLen+len(match)+len(instructions))
+	binary.BigEndian.PutUint64(b, f.Cookie)
+	binary.BigEndian.PutUint64(b[8:], f.CookieMask)
+	b[16] = f.Table
+	b[17] = f.Command
+	binary.BigEndian.PutUint16(b[18:], f.IdleTimeout)
+	binary.BigEndian.PutUint16(b[20:], f.HardTimeout)
+	binary.BigEndian.PutUint16(b[22:], f.Priority)
+	binary.BigEndian.PutUint32(b[24:], noBuffer)
+	binary.BigEndian.PutUint32(b[28:], PortAny)
+	binary.BigEndian.PutUint32(b[32:], GroupAny)
+	copy(b[flowModFixedLen:], match)
+	copy(b[flowModFixedLen+len(match):], instructions)
+	return b, nil
+}
+
+func marshalApplyActions(actions []Action) ([]byte, error) {
+	if len(actions) == 0 {
+		// no instruction drops the packet
+		return nil, nil
+	}
+	encoded := marshalActions(actions)
+	if 8+len(encoded) > maxLen {
+		return nil, ErrTooLong
+	}
+	b := make([]byte, 8+len(encoded))
+	binary.BigEndian.PutUint16(b, instructionApply)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	copy(b[8:], encoded)
+	return b, nil
+}
+
+// String returns the flow in ovs-ofctl add-flow/del-flows syntax
+func (f *FlowMod) String() string {
+	parts := []string{"table=" + strconv.Itoa(int(f.Table))}
+	isDelete := f.Command == FlowDelete || f.Command == FlowDeleteStrict
+	if !isDelete || f.Command == FlowDeleteStrict {
+		parts = append(parts, "priority="+strconv.Itoa(int(f.Priority)))
+	}
+	if f.Cookie != 0 || f.CookieMask != 0 {
+		cookie := fmt.Sprintf("cookie=0x%x", f.Cookie)
+		if f.CookieMask != 0 {
+			cookie += fmt.Sprintf("/0x%x", f.CookieMask)
+		}
+		parts = append(parts, cookie)
+	}
+	if f.IdleTimeout != 0 {
+		parts = append(parts, "idle_timeout="+strconv.Itoa(int(f.IdleTimeout)))
+	}
+	if f.HardTimeout != 0 {
+		parts = append(parts, "hard_timeout="+strconv.Itoa(int(f.HardTimeout)))
+	}
+	if match := f.Match.String(); match != "" {
+		parts = append(parts, match)
+	}
+	if !isDelete {
+		parts = append(parts, "actions="+ActionsString(f.Actions))
+	}
+	return strings.Join(parts, ",")
+}
+
+// FlowStats is a flow as reported by the switch
+type FlowStats struct {
+	Table       uint8
+	Priority    uint16
+	IdleTimeout uint16
+	HardTimeout uint16
+	Cookie      uint64
+	PacketCount uint64
+	ByteCount   uint64
+	DurationSec uint32
+	Match       Match
+	Actions     []Action
+}
+
+func (f *FlowStats) String() string {
+	mod := FlowMod{Table: f.Table, Priority: f.Priority, Cookie: f.Cookie, IdleTimeout: f.IdleTimeout,
+		HardTimeout: f.HardTimeout, Match: f.Match, Actions: f.Actions}
+	return mod.String()
+}
+
+// DumpFlows returns the flows of a table (or TableAll) whose cookie matches
+// cookie in the bits of cookieMask
+func (c *Conn) DumpFlows(table uint8, cookie uint64, cookieMask uint64) ([]*FlowStats, error) {
+	match := Match{}.marshal()
+	body := make([]byte, 32+len(match))
+	body[0] = table
+	binary.BigEndian.PutUint32(body[4:], PortAny)
+	binary.BigEndian.PutUint32(body[8:], GroupAny)
+	binary.BigEndian.PutUint64(body[16:], cookie)
+	binary.BigEndian.PutUint64(body[24:], cookieMask)
+	copy(body[32:], match)
+	reply, err := c.multipart(multipartFlow, body)
+	if err != nil {
+		return nil, err
+	}
+	var flows []*FlowStats
+	for len(reply) > 0 {
+		if len(reply) < flowStatsFixedLen {
+			return nil, fmt.Errorf("openflow: truncated flow stats")
+		}
+		length := int(binary.BigEndian.Uint16(reply))
+		if length < flowStatsFixedLen || length > len(reply) {
+			return nil, fmt.Errorf("openflow: invalid flow stats length %d", length)
+		}
+		flow, err := unmarshalFlowStats(reply[:length])
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, flow)
+		reply = reply[length:]
+	}
+	return flows, nil
+}
+
+func unmarshalFlowStats(b []byte) (*FlowStats, error) {
+	flow := &FlowStats{
+		Table:       b[2],
+		DurationSec: binary.BigEndian.Uint32(b[4:]),
+		Priority:    binary.BigEndian.Uint16(b[12:]),
+		IdleTimeout: binary.BigEndian.Uint16(b[14:]),
+		HardTimeout: binary.BigEndian.Uint16(b[16:]),
+		Cookie:      binary.BigEndian.Uint64(b[24:]),
+		PacketCount: binary.BigEndian.Uint64(b[32:]),
+		ByteCount:   binary.BigEndian.Uint64(b[40:]),
+	}
+	match, n, err := unmarshalMatch(b[flowStatsFixedLen:])
+	if err != nil {
+		return nil, err
+	}
+	flow.Match = match
+	instructions := b[flowStatsFixedLen+n:]
+	for len(instructions) >= 4 {
+		instructionType := binary.BigEndian.Uint16(instructions)
+		length := int(binary.BigEndian.Uint16(instructions[2:]))
+		if length < 4 || length > len(instructions) {
+			return nil, fmt.Errorf("openflow: invalid instruction length %d", length)
+		}
+		if instructionType == instructionApply && length >= 8 {
+			actions, err := unmarshalActions(instructions[8:length])
+			if err != nil {
+				return nil, err
+			}
+			flow.Actions = append(flow.Actions, actions...)
+		}
+		instructions = instructions[length:]
+	}
+	return flow, nil
+}
@@ -0,0 +1,136 @@
+package openflow
+
+import (
+	"net"
+	"testing"
+)
+
+func serviceFlow() *FlowMod {
+	return &FlowMod{
+		Command:  FlowAdd,
+		Table:    1,
+		Priority: 100,
+		Cookie:   0x4b535643,
+		Match:    Match{L4Dst(IPProtoTCP, 80), IPDst(net.ParseIP("10.96.0.10")), IPProto(IPProtoTCP), EthType(EthTypeIPv4)},
+		Actions:  []Action{&Group{GroupID: 100}},
+	}
+}
+
+// the match of serviceFlow, its fields in the canonical order and padded to 8 bytes
+const serviceMatch = "0001 001d 80000a02 0800 80001401 06 80001804 0a60000a 80001c02 0050 000000"
+
+func TestFlowModMarshal(t *testing.T) {
+	for _, test := range []struct {
+		flow *FlowMod
+		want string
+	}{
+		{
+			serviceFlow(),
+			"040e 0060 00000007" +
+				"000000004b535643 0000000000000000 01 00 0000 0000 0064 ffffffff ffffffff ffffffff 0000 0000" +
+				serviceMatch +
+				"0004 0010 00000000 0016 0008 00000064",
+		},
+		{
+			// deletes carry no instructions
+			&FlowMod{Command: FlowDelete, Table: TableAll, Cookie: 0x4b535643, CookieMask: 0xffffffffffffffff},
+			"040e 0038 00000007" +
+				"000000004b535643 ffffffffffffffff ff 03 0000 0000 0000 ffffffff ffffffff ffffffff 0000 0000" +
+				"0001 0004 00000000",
+		},
+	} {
+		body, err := test.flow.marshalBody()
+		if err != nil {
+			t.Errorf("%s: %s", test.flow, err)
+			continue
+		}
+		got, err := encodeMessage(test.flow.msgType(), 7, body)
+		if err != nil {
+			t.Errorf("%s: %s", test.flow, err)
+			continue
+		}
+		if want := decodeHex(t, test.want); string(got) != string(want) {
+			t.Errorf("%s encoded as\n%x\nwant\n%x", test.flow, got, want)
+		}
+	}
+}
+
+func TestFlowModString(t *testing.T) {
+	want := "table=1,priority=100,cookie=0x4b535643,tcp,nw_dst=10.96.0.10,tcp_dst=80,actions=group:100"
+	if got := serviceFlow().String(); got != want {
+		t.Errorf("flow formatted as\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMatchXXReg(t *testing.T) {
+	match := Match{XXReg(2, net.ParseIP("fd00::1")), Reg(4, 100), EthType(EthTypeIPv6)}
+	want := decodeHex(t, "0001 0026 80000a02 86dd 00010804 00000064 0001e210 fd000000000000000000000000000001 0000")
+	if got := match.marshal(); string(got) != string(want) {
+		t.Errorf("%s encoded as\n%x\nwant\n%x", match, got, want)
+	}
+	if got, want := match.String(), "ipv6,reg4=0x64,xxreg2=0xfd000000000000000000000000000001"; got != want {
+		t.Errorf("match formatted as\n%s\nwant\n%s", got, want)
+	}
+	decoded, n, err := unmarshalMatch(want)
+	if err != nil || n != len(want) || decoded.Key() != match.Key() {
+		t.Errorf("match decoded as %s (%d bytes, %v), want %s", decoded, n, err, match)
+	}
+}
+
+// multipartReplies answers a multipart request of mpType with the parts
+func multipartReplies(t *testing.T, mpType uint16, parts ...string) func(uint8, uint32, []byte) []*rawMessage {
+	return func(msgType uint8, xid uint32, body []byte) []*rawMessage {
+		if msgType != typeMultipartRequest || len(body) < 8 || uint16(body[0])<<8|uint16(body[1]) != mpType {
+			t.Errorf("unexpected request type %d body %x", msgType, body)
+			return nil
+		}
+		var replies []*rawMessage
+		for i, part := range parts {
+			header := []byte{byte(mpType >> 8), byte(mpType), 0, 0, 0, 0, 0, 0}
+			if i < len(parts)-1 {
+				header[3] = byte(multipartReplyMore)
+			}
+			replies = append(replies, &rawMessage{msgType: typeMultipartReply, xid: xid, body: append(header, decodeHex(t, part)...)})
+		}
+		return replies
+	}
+}
+
+func TestDumpFlows(t *testing.T) {
+	// the flow of serviceFlow followed by a flow without instructions in a second reply
+	c, s := newFakeSwitch(t, multipartReplies(t, multipartFlow,
+		"0060 01 00 0000000a 00000000 0064 0000 0000 0000 00000000 000000004b535643 0000000000000003 00000000000000b4"+
+			serviceMatch+"0004 0010 00000000 0016 0008 00000064",
+		"0038 02 00 00000001 00000000 0000 0000 0000 0000 00000000 000000004b535643 0000000000000000 0000000000000000"+
+			"0001 0004 00000000"))
+	defer c.Close()
+	flows, err := c.DumpFlows(TableAll, 0x4b535643, 0xffffffffffffffff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := s.messages()[0]
+	if want := decodeHex(t, "0412 0038"); string(request[:4]) != string(want) {
+		t.Errorf("flow stats request header %x, want %x", request[:4], want)
+	}
+	if want := decodeHex(t, "0001 0000 00000000 ff 000000 ffffffff ffffffff 00000000 000000004b535643 ffffffffffffffff 0001 0004 00000000"); string(request[8:]) != string(want) {
+		t.Errorf("flow stats request body %x, want %x", request[8:], want)
+	}
+	if len(flows) != 2 {
+		t.Fatalf("got %d flows, want 2", len(flows))
+	}
+	want := serviceFlow()
+	flow := flows[0]
+	if flow.Table != want.Table || flow.Priority != want.Priority || flow.Cookie != want.Cookie ||
+		flow.DurationSec != 10 || flow.PacketCount != 3 || flow.ByteCount != 180 {
+		t.Errorf("decoded flow %+v", flow)
+	}
+	if flow.Match.Key() != want.Match.Key() || !ActionsEqual(flow.Actions, want.Actions) {
+		t.Errorf("decoded flow %s, want %s", flow, want)
+	}
+	if flows[1].Table != 2 || len(flows[1].Match) != 0 || len(flows[1].Actions) != 0 {
+		t.Errorf("decoded flow %s, want an empty flow in table 2", flows[1])
+	}
+	if got := flows[1].String(); got != "table=2,priority=0,cookie=0x4b535643,actions=drop" {
+		t.Errorf("decoded flow formatted as %s", got)
+	}
+}
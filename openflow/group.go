@@ -0,0 +1,213 @@
+package openflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// group-mod commands
+const (
+	GroupAdd    uint16 = 0
+	GroupModify uint16 = 1
+	GroupDelete uint16 = 2
+)
+
+// group types
+const (
+	GroupTypeAll      uint8 = 0
+	GroupTypeSelect   uint8 = 1
+	GroupTypeIndirect uint8 = 2
+)
+
+var groupTypeNames = map[uint8]string{GroupTypeAll: "all", GroupTypeSelect: "select", GroupTypeIndirect: "indirect", 3: "ff"}
+
+const (
+	bucketFixedLen     = 16
+	groupDescFixedLen  = 8
+	groupStatsFixedLen = 40
+)
+
+// Bucket of a group, Weight is only used by select groups
+type Bucket struct {
+	Weight  uint16
+	Actions []Action
+}
+
+func (b *Bucket) marshal() ([]byte, error) {
+	actions := marshalActions(b.Actions)
+	if bucketFixedLen+len(actions) > maxLen {
+		return nil, ErrTooLong
+	}
+	buf := make([]byte, bucketFixedLen+len(actions))
+	binary.BigEndian.PutUint16(buf, uint16(len(buf)))
+	binary.BigEndian.PutUint16(buf[2:], b.Weight)
+	binary.BigEndian.PutUint32(buf[4:], PortAny)
+	binary.BigEndian.PutUint32(buf[8:], GroupAny)
+	copy(buf[bucketFixedLen:], actions)
+	return buf, nil
+}
+
+func (b *Bucket) String() string {
+	return "bucket=weight:" + strconv.Itoa(int(b.Weight)) + ",actions=" + ActionsString(b.Actions)
+}
+
+// GroupMod adds, modifies or deletes a group, GroupAll deletes every group
+type GroupMod struct {
+	Command uint16
+	Type    uint8
+	GroupID uint32
+	Buckets []Bucket
+}
+
+func (g *GroupMod) msgType() uint8 {
+	return typeGroupMod
+}
+
+func (g *GroupMod) marshalBody() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b, g.Command)
+	b[2] = g.Type
+	binary.BigEndian.PutUint32(b[4:], g.GroupID)
+	for i := range g.Buckets {
+		bucket, err := g.Buckets[i].marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, bucket...)
+	}
+	return b, nil
+}
+
+// String returns the group in ovs-ofctl add-group syntax
+func (g *GroupMod) String() string {
+	if g.Command == GroupDelete {
+		if g.GroupID == GroupAll {
+			return "group_id=all"
+		}
+		return "group_id=" + strconv.FormatUint(uint64(g.GroupID), 10)
+	}
+	return groupString(g.GroupID, g.Type, g.Buckets)
+}
+
+func groupString(groupID uint32, groupType uint8, buckets []Bucket) string {
+	parts := []string{"group_id=" + strconv.FormatUint(uint64(groupID), 10), "type=" + groupTypeNames[groupType]}
+	for i := range buckets {
+		parts = append(parts, buckets[i].String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// BucketsEqual compares the wire encoding of two bucket lists
+func BucketsEqual(a []Bucket, b []Bucket) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		bucketA, errA := a[i].marshal()
+		bucketB, errB := b[i].marshal()
+		if errA != nil || errB != nil || string(bucketA) != string(bucketB) {
+			return false
+		}
+	}
+	return true
+}
+
+// GroupDesc is a group as reported by the switch
+type GroupDesc struct {
+	Type    uint8
+	GroupID uint32
+	Buckets []Bucket
+}
+
+func (g *GroupDesc) String() string {
+	return groupString(g.GroupID, g.Type, g.Buckets)
+}
+
+// DumpGroups returns the description of all groups
+func (c *Conn) DumpGroups() ([]*GroupDesc, error) {
+	reply, err := c.multipart(multipartGroupDesc, nil)
+	if err != nil {
+		return nil, err
+	}
+	var groups []*GroupDesc
+	for len(reply) > 0 {
+		if len(reply) < groupDescFixedLen {
+			return nil, fmt.Errorf("openflow: truncated group description")
+		}
+		length := int(binary.BigEndian.Uint16(reply))
+		if length < groupDescFixedLen || length > len(reply) {
+			return nil, fmt.Errorf("openflow: invalid group description length %d", length)
+		}
+		group := &GroupDesc{Type: reply[2], GroupID: binary.BigEndian.Uint32(reply[4:])}
+		buckets := reply[groupDescFixedLen:length]
+		for len(buckets) > 0 {
+			if len(buckets) < bucketFixedLen {
+				return nil, fmt.Errorf("openflow: truncated bucket")
+			}
+			bucketLen := int(binary.BigEndian.Uint16(buckets))
+			if bucketLen < bucketFixedLen || bucketLen > len(buckets) {
+				return nil, fmt.Errorf("openflow: invalid bucket length %d", bucketLen)
+			}
+			actions, err := unmarshalActions(buckets[bucketFixedLen:bucketLen])
+			if err != nil {
+				return nil, err
+			}
+			group.Buckets = append(group.Buckets, Bucket{Weight: binary.BigEndian.Uint16(buckets[2:]), Actions: actions})
+			buckets = buckets[bucketLen:]
+		}
+		groups = append(groups, group)
+		reply = reply[length:]
+	}
+	return groups, nil
+}
+
+// GroupStats are the counters of a group and its buckets
+type GroupStats struct {
+	GroupID      uint32
+	RefCount     uint32
+	PacketCount  uint64
+	ByteCount    uint64
+	BucketCounts []BucketCounter
+}
+
+type BucketCounter struct {
+	PacketCount uint64
+	ByteCount   uint64
+}
+
+// DumpGroupStats returns the counters of all groups
+func (c *Conn) DumpGroupStats() ([]*GroupStats, error) {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint32(body, GroupAll)
+	reply, err := c.multipart(multipartGroup, body)
+	if err != nil {
+		return nil, err
+	}
+	var stats []*GroupStats
+	for len(reply) > 0 {
+		if len(reply) < groupStatsFixedLen {
+			return nil, fmt.Errorf("openflow: truncated group stats")
+		}
+		length := int(binary.BigEndian.Uint16(reply))
+		if length < groupStatsFixedLen || length > len(reply) {
+			return nil, fmt.Errorf("openflow: invalid group stats length %d", length)
+		}
+		group := &GroupStats{
+			GroupID:     binary.BigEndian.Uint32(reply[4:]),
+			RefCount:    binary.BigEndian.Uint32(reply[8:]),
+			PacketCount: binary.BigEndian.Uint64(reply[16:]),
+			ByteCount:   binary.BigEndian.Uint64(reply[24:]),
+		}
+		for counters := reply[groupStatsFixedLen:length]; len(counters) >= 16; counters = counters[16:] {
+			group.BucketCounts = append(group.BucketCounts, BucketCounter{
+				PacketCount: binary.BigEndian.Uint64(counters),
+				ByteCount:   binary.BigEndian.Uint64(counters[8:]),
+			})
+		}
+		stats = append(stats, group)
+		reply = reply[length:]
+	}
+	return stats, nil
+}
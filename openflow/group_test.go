@@ -0,0 +1,108 @@
+package openflow
+
+import (
+	"net"
+	"testing"
+)
+
+func serviceBuckets() []Bucket {
+	nat := &Nat{Flags: NatDst, IP: net.ParseIP("10.0.0.1"), Port: 8080}
+	return []Bucket{{Weight: 100, Actions: []Action{&Conntrack{Commit: true, Recirc: true, Table: 2, Actions: []Action{nat}}}}}
+}
+
+// the bucket of serviceBuckets, ct(commit,nat(dst=10.0.0.1:8080),table=2)
+const serviceBucket = "0040 0064 ffffffff ffffffff 00000000" +
+	"ffff 0030 00002320 0023 0001 00000000 0000 02 000000 0000" +
+	"ffff 0018 00002320 0024 0000 0002 0011 0a000001 1f90 0000"
+
+func TestGroupModMarshal(t *testing.T) {
+	for _, test := range []struct {
+		group *GroupMod
+		want  string
+	}{
+		{
+			&GroupMod{Command: GroupAdd, Type: GroupTypeSelect, GroupID: 100, Buckets: serviceBuckets()},
+			"040f 0050 00000007 0000 01 00 00000064" + serviceBucket,
+		},
+		{
+			&GroupMod{Command: GroupDelete, GroupID: GroupAll},
+			"040f 0010 00000007 0002 00 00 fffffffc",
+		},
+	} {
+		body, err := test.group.marshalBody()
+		if err != nil {
+			t.Errorf("%s: %s", test.group, err)
+			continue
+		}
+		got, err := encodeMessage(test.group.msgType(), 7, body)
+		if err != nil {
+			t.Errorf("%s: %s", test.group, err)
+			continue
+		}
+		if want := decodeHex(t, test.want); string(got) != string(want) {
+			t.Errorf("%s encoded as\n%x\nwant\n%x", test.group, got, want)
+		}
+	}
+}
+
+func TestGroupModString(t *testing.T) {
+	group := &GroupMod{Command: GroupAdd, Type: GroupTypeSelect, GroupID: 100, Buckets: serviceBuckets()}
+	want := "group_id=100,type=select,bucket=weight:100,actions=ct(commit,nat(dst=10.0.0.1:8080),table=2)"
+	if got := group.String(); got != want {
+		t.Errorf("group formatted as\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDumpGroups(t *testing.T) {
+	c, _ := newFakeSwitch(t, multipartReplies(t, multipartGroupDesc,
+		"0048 01 00 00000064"+serviceBucket,
+		"0008 00 00 00000065"))
+	defer c.Close()
+	groups, err := c.DumpGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want 2", len(groups))
+	}
+	if groups[0].GroupID != 100 || groups[0].Type != GroupTypeSelect || !BucketsEqual(groups[0].Buckets, serviceBuckets()) {
+		t.Errorf("decoded group %s", groups[0])
+	}
+	if groups[1].GroupID != 101 || groups[1].Type != GroupTypeAll || len(groups[1].Buckets) != 0 {
+		t.Errorf("decoded group %s, want an empty group 101", groups[1])
+	}
+}
+
+func TestDumpGroupsInvalid(t *testing.T) {
+	// the bucket claims more bytes than the group has
+	c, _ := newFakeSwitch(t, multipartReplies(t, multipartGroupDesc, "0018 01 00 00000064 0020 0064 ffffffff ffffffff 00000000"))
+	defer c.Close()
+	if _, err := c.DumpGroups(); err == nil {
+		t.Errorf("truncated bucket decoded without error")
+	}
+}
+
+func TestDumpGroupStats(t *testing.T) {
+	c, s := newFakeSwitch(t, multipartReplies(t, multipartGroup,
+		"0048 0000 00000064 00000001 00000000 000000000000000a 00000000000003e8 00000005 00000000"+
+			"0000000000000004 0000000000000190 0000000000000006 0000000000000258"))
+	defer c.Close()
+	stats, err := c.DumpGroupStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := decodeHex(t, "0412 0018 00000001 0006 0000 00000000 fffffffc 00000000"); string(s.messages()[0]) != string(want) {
+		t.Errorf("group stats request %x, want %x", s.messages()[0], want)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("got %d group stats, want 1", len(stats))
+	}
+	group := stats[0]
+	if group.GroupID != 100 || group.RefCount != 1 || group.PacketCount != 10 || group.ByteCount != 1000 {
+		t.Errorf("decoded group stats %+v", group)
+	}
+	want := []BucketCounter{{PacketCount: 4, ByteCount: 400}, {PacketCount: 6, ByteCount: 600}}
+	if len(group.BucketCounts) != len(want) || group.BucketCounts[0] != want[0] || group.BucketCounts[1] != want[1] {
+		t.Errorf("decoded bucket counters %+v, want %+v", group.BucketCounts, want)
+	}
+}
@@ -0,0 +1,513 @@
+package openflow
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Field identifies an OXM/NXM match field
+type Field struct {
+	Class uint16
+	Field uint8
+	Len   uint8
+}
+
+const (
+	classNXM0     uint16 = 0x0000
+	classNXM1     uint16 = 0x0001
+	classOpenFlow uint16 = 0x8000
+)
+
+var (
+	FieldInPort  = Field{classOpenFlow, 0, 4}
+	FieldEthDst  = Field{classOpenFlow, 3, 6}
+	FieldEthSrc  = Field{classOpenFlow, 4, 6}
+	FieldEthType = Field{classOpenFlow, 5, 2}
+	FieldIPProto = Field{classOpenFlow, 10, 1}
+	FieldIPv4Src = Field{classOpenFlow, 11, 4}
+	FieldIPv4Dst = Field{classOpenFlow, 12, 4}
+	FieldTCPSrc  = Field{classOpenFlow, 13, 2}
+	FieldTCPDst  = Field{classOpenFlow, 14, 2}
+	FieldUDPSrc  = Field{classOpenFlow, 15, 2}
+	FieldUDPDst  = Field{classOpenFlow, 16, 2}
+	FieldSCTPSrc = Field{classOpenFlow, 17, 2}
+	FieldSCTPDst = Field{classOpenFlow, 18, 2}
+	FieldArpSha  = Field{classOpenFlow, 24, 6}
+	FieldArpTha  = Field{classOpenFlow, 25, 6}
+	FieldIPv6Src = Field{classOpenFlow, 26, 16}
+	FieldIPv6Dst = Field{classOpenFlow, 27, 16}
+	FieldCtState = Field{classNXM1, 105, 4}
+)
+
+// FieldReg returns the Nicira register field reg0 to reg7
+func FieldReg(n int) Field {
+	return Field{classNXM1, uint8(n), 4}
+}
+
+// NXM field number of xxreg0, the 128 bit registers need OVS 2.6
+const nxmXXReg0 = 111
+
+// FieldXXReg returns the 128 bit register xxreg0 to xxreg3, xxreg<n> overlaps reg<4n> to reg<4n+3>
+func FieldXXReg(n int) Field {
+	return Field{classNXM1, uint8(nxmXXReg0 + n), 16}
+}
+
+// ethernet types
+const (
+	EthTypeIPv4 uint16 = 0x0800
+	EthTypeARP  uint16 = 0x0806
+	EthTypeIPv6 uint16 = 0x86dd
+)
+
+// IP protocols
+const (
+	IPProtoTCP  uint8 = 6
+	IPProtoUDP  uint8 = 17
+	IPProtoSCTP uint8 = 132
+)
+
+// conntrack state bits
+const (
+	CtStateNew uint32 = 1 << iota
+	CtStateEstablished
+	CtStateRelated
+	CtStateReply
+	CtStateInvalid
+	CtStateTracked
+	CtStateSNAT
+	CtStateDNAT
+)
+
+var ctStateNames = []string{"new", "est", "rel", "rpl", "inv", "trk", "snat", "dnat"}
+
+func (f Field) header(hasMask bool) uint32 {
+	length := uint32(f.Len)
+	h := uint32(f.Class)<<16 | uint32(f.Field)<<9
+	if hasMask {
+		return h | 1<<8 | length*2
+	}
+	return h | length
+}
+
+func (f Field) isXXReg() bool {
+	return f.Class == classNXM1 && f.Field >= nxmXXReg0 && f.Field < nxmXXReg0+4 && f.Len == 16
+}
+
+// ovs-ofctl name of the field in matches and set_field actions
+func (f Field) name() string {
+	switch f {
+	case FieldInPort:
+		return "in_port"
+	case FieldEthDst:
+		return "dl_dst"
+	case FieldEthSrc:
+		return "dl_src"
+	case FieldEthType:
+		return "dl_type"
+	case FieldIPProto:
+		return "nw_proto"
+	case FieldIPv4Src:
+		return "nw_src"
+	case FieldIPv4Dst:
+		return "nw_dst"
+	case FieldTCPSrc:
+		return "tcp_src"
+	case FieldTCPDst:
+		return "tcp_dst"
+	case FieldUDPSrc:
+		return "udp_src"
+	case FieldUDPDst:
+		return "udp_dst"
+	case FieldSCTPSrc:
+		return "sctp_src"
+	case FieldSCTPDst:
+		return "sctp_dst"
+	case FieldArpSha:
+		return "arp_sha"
+	case FieldArpTha:
+		return "arp_tha"
+	case FieldIPv6Src:
+		return "ipv6_src"
+	case FieldIPv6Dst:
+		return "ipv6_dst"
+	case FieldCtState:
+		return "ct_state"
+	}
+	if f.Class == classNXM1 && f.Field < 8 && f.Len == 4 {
+		return "reg" + strconv.Itoa(int(f.Field))
+	}
+	if f.isXXReg() {
+		return "xxreg" + strconv.Itoa(int(f.Field)-nxmXXReg0)
+	}
+	return fmt.Sprintf("field(0x%08x)", f.header(false))
+}
+
+// OVS encodes the fields of learn specs with their NXM header if the field
+// has one and dumps them that way, whatever header the spec was added with
+var nxmFields = map[Field]Field{
+	FieldEthDst:  {classNXM0, 1, 6},
+	FieldEthSrc:  {classNXM0, 2, 6},
+	FieldEthType: {classNXM0, 3, 2},
+	FieldIPProto: {classNXM0, 6, 1},
+	FieldIPv4Src: {classNXM0, 7, 4},
+	FieldIPv4Dst: {classNXM0, 8, 4},
+	FieldTCPSrc:  {classNXM0, 9, 2},
+	FieldTCPDst:  {classNXM0, 10, 2},
+	FieldUDPSrc:  {classNXM0, 11, 2},
+	FieldUDPDst:  {classNXM0, 12, 2},
+	FieldArpSha:  {classNXM1, 17, 6},
+	FieldArpTha:  {classNXM1, 18, 6},
+	FieldIPv6Src: {classNXM1, 19, 16},
+	FieldIPv6Dst: {classNXM1, 20, 16},
+}
+
+func (f Field) learnHeader() uint32 {
+	if nxm, ok := nxmFields[f]; ok {
+		return nxm.header(false)
+	}
+	return f.header(false)
+}
+
+// NXM/OXM name of the field as used in learn specs
+func (f Field) subfieldName() string {
+	switch f {
+	case FieldEthType:
+		return "NXM_OF_ETH_TYPE"
+	case FieldIPProto:
+		return "NXM_OF_IP_PROTO"
+	case FieldIPv4Src:
+		return "NXM_OF_IP_SRC"
+	case FieldIPv4Dst:
+		return "NXM_OF_IP_DST"
+	case FieldIPv6Src:
+		return "NXM_NX_IPV6_SRC"
+	case FieldIPv6Dst:
+		return "NXM_NX_IPV6_DST"
+	case FieldTCPDst:
+		return "NXM_OF_TCP_DST"
+	case FieldUDPDst:
+		return "NXM_OF_UDP_DST"
+	case FieldSCTPDst:
+		return "OXM_OF_SCTP_DST"
+	}
+	if f.Class == classNXM1 && f.Field < 8 && f.Len == 4 {
+		return "NXM_NX_REG" + strconv.Itoa(int(f.Field))
+	}
+	if f.isXXReg() {
+		return "NXM_NX_XXREG" + strconv.Itoa(int(f.Field)-nxmXXReg0)
+	}
+	return strings.ToUpper(f.name())
+}
+
+// MatchField is a single field of a match with an optional mask
+type MatchField struct {
+	Field Field
+	Value []byte
+	Mask  []byte
+}
+
+// Match is an OXM match, the fields are ANDed
+type Match []MatchField
+
+func uint16Bytes(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func InPort(port uint32) MatchField {
+	return MatchField{Field: FieldInPort, Value: uint32Bytes(port)}
+}
+
+func EthType(ethType uint16) MatchField {
+	return MatchField{Field: FieldEthType, Value: uint16Bytes(ethType)}
+}
+
+func IPProto(proto uint8) MatchField {
+	return MatchField{Field: FieldIPProto, Value: []byte{proto}}
+}
+
+// IPDst matches the IPv4 or IPv6 destination address depending on the family of ip
+func IPDst(ip net.IP) MatchField {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return MatchField{Field: FieldIPv4Dst, Value: []byte(ipv4)}
+	}
+	return MatchField{Field: FieldIPv6Dst, Value: []byte(ip.To16())}
+}
+
+// IPSrc matches the IPv4 or IPv6 source address depending on the family of ip
+func IPSrc(ip net.IP) MatchField {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return MatchField{Field: FieldIPv4Src, Value: []byte(ipv4)}
+	}
+	return MatchField{Field: FieldIPv6Src, Value: []byte(ip.To16())}
+}
+
+// L4Dst matches the destination port of the given IP protocol
+func L4Dst(proto uint8, port uint16) MatchField {
+	switch proto {
+	case IPProtoUDP:
+		return MatchField{Field: FieldUDPDst, Value: uint16Bytes(port)}
+	case IPProtoSCTP:
+		return MatchField{Field: FieldSCTPDst, Value: uint16Bytes(port)}
+	}
+	return MatchField{Field: FieldTCPDst, Value: uint16Bytes(port)}
+}
+
+func EthSrc(mac net.HardwareAddr) MatchField {
+	return MatchField{Field: FieldEthSrc, Value: []byte(mac)}
+}
+
+func EthDst(mac net.HardwareAddr) MatchField {
+	return MatchField{Field: FieldEthDst, Value: []byte(mac)}
+}
+
+func ArpSha(mac net.HardwareAddr) MatchField {
+	return MatchField{Field: FieldArpSha, Value: []byte(mac)}
+}
+
+func ArpTha(mac net.HardwareAddr) MatchField {
+	return MatchField{Field: FieldArpTha, Value: []byte(mac)}
+}
+
+func Reg(n int, value uint32) MatchField {
+	return MatchField{Field: FieldReg(n), Value: uint32Bytes(value)}
+}
+
+// XXReg matches the 128 bit register on an IPv6 address
+func XXReg(n int, ip net.IP) MatchField {
+	return MatchField{Field: FieldXXReg(n), Value: []byte(ip.To16())}
+}
+
+func RegMasked(n int, value uint32, mask uint32) MatchField {
+	return MatchField{Field: FieldReg(n), Value: uint32Bytes(value), Mask: uint32Bytes(mask)}
+}
+
+// CtState matches the conntrack state bits selected by mask
+func CtState(state uint32, mask uint32) MatchField {
+	return MatchField{Field: FieldCtState, Value: uint32Bytes(state), Mask: uint32Bytes(mask)}
+}
+
+func (m MatchField) len() int {
+	return 4 + len(m.Value) + len(m.Mask)
+}
+
+func (m MatchField) marshal(b []byte) int {
+	binary.BigEndian.PutUint32(b, m.Field.header(m.Mask != nil))
+	n := 4 + copy(b[4:], m.Value)
+	return n + copy(b[n:], m.Mask)
+}
+
+func (m MatchField) valueString() string {
+	return formatFieldValue(m.Field, m.Value)
+}
+
+func formatFieldValue(f Field, value []byte) string {
+	switch f {
+	case FieldIPv4Src, FieldIPv4Dst, FieldIPv6Src, FieldIPv6Dst:
+		return net.IP(value).String()
+	case FieldEthSrc, FieldEthDst, FieldArpSha, FieldArpTha:
+		return net.HardwareAddr(value).String()
+	case FieldEthType:
+		return fmt.Sprintf("0x%04x", binary.BigEndian.Uint16(value))
+	case FieldCtState:
+		return fmt.Sprintf("0x%x", binary.BigEndian.Uint32(value))
+	}
+	if f.isXXReg() {
+		return hexValue(value)
+	}
+	var v uint64
+	for _, octet := range value {
+		v = v<<8 | uint64(octet)
+	}
+	if f.Class == classNXM1 && f.Len == 4 {
+		return fmt.Sprintf("0x%x", v)
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+func hexValue(value []byte) string {
+	// a value of any length as a hex number without leading zeros
+	digits := strings.TrimLeft(hex.EncodeToString(value), "0")
+	if digits == "" {
+		digits = "0"
+	}
+	return "0x" + digits
+}
+
+func (m MatchField) String() string {
+	if m.Field == FieldCtState && m.Mask != nil {
+		// ct_state is written as +flag/-flag for the bits in the mask
+		state := binary.BigEndian.Uint32(m.Value)
+		mask := binary.BigEndian.Uint32(m.Mask)
+		flags := ""
+		for i, name := range ctStateNames {
+			if mask&(1<<uint(i)) == 0 {
+				continue
+			}
+			if state&(1<<uint(i)) != 0 {
+				flags += "+" + name
+			} else {
+				flags += "-" + name
+			}
+		}
+		return "ct_state=" + flags
+	}
+	s := m.Field.name() + "=" + m.valueString()
+	if m.Mask != nil {
+		s += "/" + formatFieldValue(m.Field, m.Mask)
+	}
+	return s
+}
+
+func (m Match) get(f Field) *MatchField {
+	for i := range m {
+		if m[i].Field == f {
+			return &m[i]
+		}
+	}
+	return nil
+}
+
+type byField Match
+
+func (m byField) Len() int      { return len(m) }
+func (m byField) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m byField) Less(i, j int) bool {
+	if m[i].Field.Class != m[j].Field.Class {
+		// OpenFlow basic fields first, they carry the prerequisites
+		return m[i].Field.Class > m[j].Field.Class
+	}
+	return m[i].Field.Field < m[j].Field.Field
+}
+
+// sorted returns the fields in the canonical order used on the wire and in strings
+func (m Match) sorted() Match {
+	fields := make(Match, len(m))
+	copy(fields, m)
+	sort.Stable(byField(fields))
+	return fields
+}
+
+// Key returns a canonical representation, two matches with the same key are equal
+func (m Match) Key() string {
+	return m.String()
+}
+
+// String returns the match in ovs-ofctl syntax, e.g. "tcp,nw_dst=10.0.0.1,tcp_dst=80"
+func (m Match) String() string {
+	var parts []string
+	ethType := m.get(FieldEthType)
+	proto := m.get(FieldIPProto)
+	protoDone := false
+	if ethType != nil && ethType.Mask == nil {
+		ethValue := binary.BigEndian.Uint16(ethType.Value)
+		switch ethValue {
+		case EthTypeIPv4, EthTypeIPv6:
+			suffix := ""
+			if ethValue == EthTypeIPv6 {
+				suffix = "6"
+			}
+			name := "ip"
+			if ethValue == EthTypeIPv6 {
+				name = "ipv6"
+			}
+			if proto != nil && proto.Mask == nil {
+				switch proto.Value[0] {
+				case IPProtoTCP:
+					name, protoDone = "tcp"+suffix, true
+				case IPProtoUDP:
+					name, protoDone = "udp"+suffix, true
+				case IPProtoSCTP:
+					name, protoDone = "sctp"+suffix, true
+				}
+			}
+			parts = append(parts, name)
+		case EthTypeARP:
+			parts = append(parts, "arp")
+		default:
+			parts = append(parts, ethType.String())
+		}
+	}
+	for _, field := range m.sorted() {
+		if field.Field == FieldEthType && ethType != nil && ethType.Mask == nil {
+			continue
+		}
+		if field.Field == FieldIPProto && protoDone {
+			continue
+		}
+		parts = append(parts, field.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m Match) marshal() []byte {
+	// ofp_match of type OXM padded to a multiple of 8 bytes
+	length := 4
+	for _, field := range m {
+		length += field.len()
+	}
+	b := make([]byte, pad8(length))
+	binary.BigEndian.PutUint16(b, 1)
+	binary.BigEndian.PutUint16(b[2:], uint16(length))
+	n := 4
+	for _, field := range m.sorted() {
+		n += field.marshal(b[n:])
+	}
+	return b
+}
+
+func unmarshalMatch(b []byte) (Match, int, error) {
+	// returns the match and the number of bytes consumed including padding
+	if len(b) < 4 {
+		return nil, 0, fmt.Errorf("openflow: short match")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length < 4 || pad8(length) > len(b) {
+		return nil, 0, fmt.Errorf("openflow: invalid match length %d", length)
+	}
+	var m Match
+	for n := 4; n < length; {
+		field, fieldLen, err := unmarshalMatchField(b[n:length])
+		if err != nil {
+			return nil, 0, err
+		}
+		m = append(m, field)
+		n += fieldLen
+	}
+	return m, pad8(length), nil
+}
+
+func unmarshalMatchField(b []byte) (MatchField, int, error) {
+	// decodes a single OXM TLV and returns it with its length
+	if len(b) < 4 {
+		return MatchField{}, 0, fmt.Errorf("openflow: truncated match field")
+	}
+	header := binary.BigEndian.Uint32(b)
+	hasMask := header&(1<<8) != 0
+	fieldLen := int(header & 0xff)
+	if 4+fieldLen > len(b) || (hasMask && fieldLen%2 != 0) {
+		return MatchField{}, 0, fmt.Errorf("openflow: truncated match field")
+	}
+	field := MatchField{Field: Field{Class: uint16(header >> 16), Field: uint8(header >> 9 & 0x7f), Len: uint8(fieldLen)}}
+	value := b[4 : 4+fieldLen]
+	if hasMask {
+		field.Field.Len = uint8(fieldLen / 2)
+		field.Value = append([]byte{}, value[:fieldLen/2]...)
+		field.Mask = append([]byte{}, value[fieldLen/2:]...)
+	} else {
+		field.Value = append([]byte{}, value...)
+	}
+	return field, 4 + fieldLen, nil
+}
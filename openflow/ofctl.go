@@ -0,0 +1,24 @@
+package openflow
+
+import "fmt"
+
+var flowCommandNames = map[uint8]string{
+	FlowAdd: "add", FlowModify: "modify", FlowModifyStrict: "modify_strict",
+	FlowDelete: "delete", FlowDeleteStrict: "delete_strict",
+}
+
+var groupCommandNames = map[uint16]string{GroupAdd: "add", GroupModify: "modify", GroupDelete: "delete"}
+
+// OfctlLine returns msg as a line of the file of "ovs-ofctl -O OpenFlow13 add-flows br0 FILE"
+// for a flow-mod, e.g. "add table=1,priority=100,...,actions=group:100", and of the file of
+// "ovs-ofctl -O OpenFlow13 add-groups br0 FILE" for a group-mod, e.g. "delete group_id=100".
+// Both commands take the command keyword in front of the spec.
+func OfctlLine(msg Message) string {
+	switch m := msg.(type) {
+	case *FlowMod:
+		return flowCommandNames[m.Command] + " " + m.String()
+	case *GroupMod:
+		return groupCommandNames[m.Command] + " " + m.String()
+	}
+	return fmt.Sprintf("# unsupported message %s", msg)
+}
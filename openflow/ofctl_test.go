@@ -0,0 +1,20 @@
+package openflow
+
+import "testing"
+
+func TestOfctlLine(t *testing.T) {
+	for _, test := range []struct {
+		msg  Message
+		want string
+	}{
+		{serviceFlow(), "add table=1,priority=100,cookie=0x4b535643,tcp,nw_dst=10.96.0.10,tcp_dst=80,actions=group:100"},
+		{&FlowMod{Command: FlowDelete, Table: 1, Match: Match{Reg(4, 100)}}, "delete table=1,reg4=0x64"},
+		{&GroupMod{Command: GroupModify, Type: GroupTypeSelect, GroupID: 100, Buckets: serviceBuckets()},
+			"modify group_id=100,type=select,bucket=weight:100,actions=ct(commit,nat(dst=10.0.0.1:8080),table=2)"},
+		{&GroupMod{Command: GroupDelete, GroupID: 100}, "delete group_id=100"},
+	} {
+		if got := OfctlLine(test.msg); got != test.want {
+			t.Errorf("ovs-ofctl line\n%s\nwant\n%s", got, test.want)
+		}
+	}
+}
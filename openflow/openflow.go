@@ -0,0 +1,408 @@
+// Package openflow is a minimal OpenFlow 1.3 client for Open vSwitch bridges.
+//
+// It speaks the wire protocol directly over the management socket of a bridge
+// and supports the subset the kube plugins need: flow-mod, group-mod, barrier
+// and flow/group statistics, including the Nicira extensions used for
+// conntrack, NAT and learn actions.
+package openflow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	Version uint8 = 0x04
+
+	// default location of the OVS management sockets
+	RunDir string = "/var/run/openvswitch"
+)
+
+// message types
+const (
+	typeHello            uint8 = 0
+	typeError            uint8 = 1
+	typeEchoRequest      uint8 = 2
+	typeEchoReply        uint8 = 3
+	typeExperimenter     uint8 = 4
+	typeFlowMod          uint8 = 14
+	typeGroupMod         uint8 = 15
+	typeMultipartRequest uint8 = 18
+	typeMultipartReply   uint8 = 19
+	typeBarrierRequest   uint8 = 20
+	typeBarrierReply     uint8 = 21
+)
+
+const (
+	headerLen = 8
+
+	// every length on the wire is 16 bits wide, including the message length
+	maxLen = 0xffff
+)
+
+var (
+	// Timeout bounds the wait for a reply of the switch
+	Timeout = 30 * time.Second
+
+	ErrClosed  = errors.New("openflow: connection closed")
+	ErrTimeout = errors.New("openflow: timeout waiting for reply")
+	// ErrTooLong is returned for a message, a bucket or an instruction longer
+	// than 65535 bytes, nothing of the messages is sent then
+	ErrTooLong = errors.New("openflow: message longer than 65535 bytes")
+)
+
+// Message is an OpenFlow message that can be sent to the switch
+type Message interface {
+	msgType() uint8
+	marshalBody() ([]byte, error)
+	String() string
+}
+
+// Error is an OFPT_ERROR returned by the switch for a request
+type Error struct {
+	Type uint16
+	Code uint16
+	Data []byte
+}
+
+// error types and codes the callers are interested in
+const (
+	ErrTypeBadRequest     uint16 = 1
+	ErrTypeBadAction      uint16 = 2
+	ErrTypeBadMatch       uint16 = 4
+	ErrTypeFlowModFailed  uint16 = 5
+	ErrTypeGroupModFailed uint16 = 6
+
+	ErrCodeGroupExists  uint16 = 0
+	ErrCodeUnknownGroup uint16 = 8
+)
+
+var errorTypeNames = map[uint16]string{
+	0: "HELLO_FAILED", 1: "BAD_REQUEST", 2: "BAD_ACTION", 3: "BAD_INSTRUCTION", 4: "BAD_MATCH",
+	5: "FLOW_MOD_FAILED", 6: "GROUP_MOD_FAILED", 7: "PORT_MOD_FAILED", 8: "TABLE_MOD_FAILED",
+	9: "QUEUE_OP_FAILED", 10: "SWITCH_CONFIG_FAILED", 11: "ROLE_REQUEST_FAILED", 12: "METER_MOD_FAILED",
+	13: "TABLE_FEATURES_FAILED", 0xffff: "EXPERIMENTER",
+}
+
+func (e *Error) Error() string {
+	name, ok := errorTypeNames[e.Type]
+	if !ok {
+		name = fmt.Sprintf("type %d", e.Type)
+	}
+	return fmt.Sprintf("openflow: switch returned error %s code %d", name, e.Code)
+}
+
+// IsError reports whether err is an OpenFlow error of the given type and code
+func IsError(err error, errType uint16, errCode uint16) bool {
+	ofErr, ok := err.(*Error)
+	return ok && ofErr.Type == errType && ofErr.Code == errCode
+}
+
+type rawMessage struct {
+	msgType uint8
+	xid     uint32
+	body    []byte
+}
+
+type request struct {
+	replies chan *rawMessage
+	done    chan struct{}
+}
+
+// Conn is an OpenFlow 1.3 connection to a single bridge
+type Conn struct {
+	conn    net.Conn
+	xid     uint32
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[uint32]*request
+	closed  chan struct{}
+	err     error
+}
+
+// Dial connects to the management socket of an OVS bridge
+func Dial(bridge string) (*Conn, error) {
+	return DialSocket(RunDir + "/" + bridge + ".mgmt")
+}
+
+// DialSocket connects to an OpenFlow unix socket and negotiates OpenFlow 1.3
+func DialSocket(path string) (*Conn, error) {
+	conn, err := net.DialTimeout("unix", path, Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: conn, pending: make(map[uint32]*request), closed: make(chan struct{})}
+	if err := c.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *Conn) handshake() error {
+	// hello with a version bitmap element that only contains OpenFlow 1.3
+	hello := []byte{0, 1, 0, 8, 0, 0, 0, 1 << Version}
+	if err := c.write(typeHello, c.nextXid(), hello); err != nil {
+		return err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(Timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	version, msg, err := c.read()
+	if err != nil {
+		return err
+	}
+	if msg.msgType != typeHello {
+		return fmt.Errorf("openflow: expected hello, got message type %d", msg.msgType)
+	}
+	if version < Version {
+		return fmt.Errorf("openflow: bridge speaks version 0x%02x, OpenFlow 1.3 is not enabled", version)
+	}
+	return nil
+}
+
+// Close shuts down the connection, pending requests fail with ErrClosed
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Done is closed when the connection to the switch is lost, Err tells why.
+// A Conn is not redialed, requests fail with ErrClosed from then on.
+func (c *Conn) Done() <-chan struct{} {
+	return c.closed
+}
+
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Conn) nextXid() uint32 {
+	return atomic.AddUint32(&c.xid, 1)
+}
+
+func (c *Conn) write(msgType uint8, xid uint32, body []byte) error {
+	b, err := encodeMessage(msgType, xid, body)
+	if err != nil {
+		return err
+	}
+	return c.writeEncoded(b)
+}
+
+func (c *Conn) writeEncoded(b []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func encodeMessage(msgType uint8, xid uint32, body []byte) ([]byte, error) {
+	if headerLen+len(body) > maxLen {
+		return nil, ErrTooLong
+	}
+	b := make([]byte, headerLen+len(body))
+	b[0] = Version
+	b[1] = msgType
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint32(b[4:], xid)
+	copy(b[headerLen:], body)
+	return b, nil
+}
+
+// CheckLength returns ErrTooLong if one of the messages can't be encoded
+func CheckLength(msgs ...Message) error {
+	_, err := encodeMessages(msgs, make([]uint32, len(msgs)))
+	return err
+}
+
+func encodeMessages(msgs []Message, xids []uint32) ([][]byte, error) {
+	// all messages are encoded before the first one is written, a message
+	// that doesn't fit fails the batch without sending anything
+	encoded := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		body, err := msg.marshalBody()
+		if err != nil {
+			return nil, err
+		}
+		if encoded[i], err = encodeMessage(msg.msgType(), xids[i], body); err != nil {
+			return nil, err
+		}
+	}
+	return encoded, nil
+}
+
+func (c *Conn) read() (uint8, *rawMessage, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[2:]))
+	if length < headerLen {
+		return 0, nil, fmt.Errorf("openflow: invalid message length %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], &rawMessage{msgType: header[1], xid: binary.BigEndian.Uint32(header[4:]), body: body}, nil
+}
+
+func (c *Conn) readLoop() {
+	for {
+		_, msg, err := c.read()
+		if err != nil {
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+			close(c.closed)
+			return
+		}
+		switch msg.msgType {
+		case typeEchoRequest:
+			c.write(typeEchoReply, msg.xid, msg.body)
+			continue
+		case typeError, typeBarrierReply, typeMultipartReply, typeExperimenter:
+		default:
+			// asynchronous messages are not used
+			continue
+		}
+		c.mu.Lock()
+		req, ok := c.pending[msg.xid]
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+		select {
+		case req.replies <- msg:
+		case <-req.done:
+		}
+	}
+}
+
+func (c *Conn) register(xids ...uint32) *request {
+	req := &request{replies: make(chan *rawMessage, len(xids)), done: make(chan struct{})}
+	c.mu.Lock()
+	for _, xid := range xids {
+		c.pending[xid] = req
+	}
+	c.mu.Unlock()
+	return req
+}
+
+func (c *Conn) unregister(req *request, xids ...uint32) {
+	c.mu.Lock()
+	for _, xid := range xids {
+		delete(c.pending, xid)
+	}
+	c.mu.Unlock()
+	close(req.done)
+}
+
+func (c *Conn) wait(req *request, timer *time.Timer) (*rawMessage, error) {
+	select {
+	case msg := <-req.replies:
+		return msg, nil
+	case <-c.closed:
+		return nil, ErrClosed
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+// Send transmits the messages followed by a barrier and waits until the switch
+// processed all of them. The first error the switch returned is reported.
+func (c *Conn) Send(msgs ...Message) error {
+	xids := make([]uint32, len(msgs)+1)
+	for i := range xids {
+		xids[i] = c.nextXid()
+	}
+	encoded, err := encodeMessages(msgs, xids)
+	if err != nil {
+		return err
+	}
+	req := c.register(xids...)
+	defer c.unregister(req, xids...)
+	for _, b := range encoded {
+		if err := c.writeEncoded(b); err != nil {
+			return err
+		}
+	}
+	barrierXid := xids[len(msgs)]
+	if err := c.write(typeBarrierRequest, barrierXid, nil); err != nil {
+		return err
+	}
+	var firstErr error
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+	for {
+		msg, err := c.wait(req, timer)
+		if err != nil {
+			return err
+		}
+		if msg.msgType == typeError && firstErr == nil {
+			firstErr = decodeError(msg.body)
+		}
+		if msg.msgType == typeBarrierReply && msg.xid == barrierXid {
+			return firstErr
+		}
+	}
+}
+
+func decodeError(body []byte) error {
+	if len(body) < 4 {
+		return &Error{Type: 0xffff}
+	}
+	return &Error{Type: binary.BigEndian.Uint16(body), Code: binary.BigEndian.Uint16(body[2:]), Data: body[4:]}
+}
+
+// multipart types
+const (
+	multipartFlow      uint16 = 1
+	multipartGroup     uint16 = 6
+	multipartGroupDesc uint16 = 7
+
+	multipartReplyMore uint16 = 1
+)
+
+func (c *Conn) multipart(mpType uint16, body []byte) ([]byte, error) {
+	// sends a multipart request and returns the concatenated reply bodies
+	xid := c.nextXid()
+	req := c.register(xid)
+	defer c.unregister(req, xid)
+	b := make([]byte, 8+len(body))
+	binary.BigEndian.PutUint16(b, mpType)
+	copy(b[8:], body)
+	if err := c.write(typeMultipartRequest, xid, b); err != nil {
+		return nil, err
+	}
+	var result []byte
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+	for {
+		msg, err := c.wait(req, timer)
+		if err != nil {
+			return nil, err
+		}
+		if msg.msgType == typeError {
+			return nil, decodeError(msg.body)
+		}
+		if len(msg.body) < 8 {
+			return nil, fmt.Errorf("openflow: short multipart reply")
+		}
+		result = append(result, msg.body[8:]...)
+		if binary.BigEndian.Uint16(msg.body[2:])&multipartReplyMore == 0 {
+			return result, nil
+		}
+	}
+}
+
+func pad8(n int) int {
+	return (n + 7) / 8 * 8
+}
@@ -0,0 +1,185 @@
+package openflow
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeSwitch is the switch end of a Conn, it records every message it reads
+// and writes back what reply returns for it
+type fakeSwitch struct {
+	conn     net.Conn
+	reply    func(msgType uint8, xid uint32, body []byte) []*rawMessage
+	mu       sync.Mutex
+	received [][]byte
+}
+
+func newFakeSwitch(t *testing.T, reply func(msgType uint8, xid uint32, body []byte) []*rawMessage) (*Conn, *fakeSwitch) {
+	client, server := net.Pipe()
+	s := &fakeSwitch{conn: server, reply: reply}
+	go s.serve(t)
+	c := &Conn{conn: client, pending: make(map[uint32]*request), closed: make(chan struct{})}
+	go c.readLoop()
+	return c, s
+}
+
+func (s *fakeSwitch) serve(t *testing.T) {
+	for {
+		header := make([]byte, headerLen)
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			return
+		}
+		body := make([]byte, int(binary.BigEndian.Uint16(header[2:]))-headerLen)
+		if _, err := io.ReadFull(s.conn, body); err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.received = append(s.received, append(header, body...))
+		s.mu.Unlock()
+		xid := binary.BigEndian.Uint32(header[4:])
+		for _, msg := range s.reply(header[1], xid, body) {
+			b, err := encodeMessage(msg.msgType, msg.xid, msg.body)
+			if err != nil {
+				t.Errorf("fake switch could not encode its reply: %s", err)
+				return
+			}
+			if _, err := s.conn.Write(b); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *fakeSwitch) messages() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received
+}
+
+// barrierReplies answers barriers and ignores everything else
+func barrierReplies(msgType uint8, xid uint32, body []byte) []*rawMessage {
+	if msgType == typeBarrierRequest {
+		return []*rawMessage{{msgType: typeBarrierReply, xid: xid}}
+	}
+	return nil
+}
+
+func TestEncodeMessage(t *testing.T) {
+	b, err := encodeMessage(typeBarrierRequest, 0x01020304, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := decodeHex(t, "0414 0008 01020304"); string(b) != string(want) {
+		t.Errorf("barrier encoded as %x, want %x", b, want)
+	}
+	if _, err := encodeMessage(typeFlowMod, 1, make([]byte, maxLen-headerLen)); err != nil {
+		t.Errorf("message of 65535 bytes rejected: %s", err)
+	}
+	if _, err := encodeMessage(typeFlowMod, 1, make([]byte, maxLen-headerLen+1)); err != ErrTooLong {
+		t.Errorf("message of 65536 bytes returned %v, want ErrTooLong", err)
+	}
+}
+
+func largeGroup(buckets int) *GroupMod {
+	group := &GroupMod{Command: GroupAdd, Type: GroupTypeSelect, GroupID: 100}
+	for i := 0; i < buckets; i++ {
+		nat := &Nat{Flags: NatDst, IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 8080}
+		group.Buckets = append(group.Buckets, Bucket{Weight: 100,
+			Actions: []Action{&Conntrack{Commit: true, Recirc: true, Table: 2, Actions: []Action{nat}}}})
+	}
+	return group
+}
+
+// flowOfLength returns a flow-mod of length bytes, its instructions carry a raw action of the rest
+func flowOfLength(length int) *FlowMod {
+	return &FlowMod{Command: FlowAdd, Table: 1, Actions: []Action{&RawAction{Data: make([]byte, length-64)}}}
+}
+
+func TestSendTooLong(t *testing.T) {
+	// a bucket is 64 bytes, 1023 of them and the group-mod header fit in 65535 bytes
+	if err := CheckLength(largeGroup(1023)); err != nil {
+		t.Errorf("group of 1023 buckets rejected: %s", err)
+	}
+	c, s := newFakeSwitch(t, barrierReplies)
+	defer c.Close()
+	flow := &FlowMod{Command: FlowAdd, Table: 1, Actions: []Action{&Group{GroupID: 100}}}
+	if err := c.Send(flow, largeGroup(1024)); err != ErrTooLong {
+		t.Fatalf("Send of a group of 1024 buckets returned %v, want ErrTooLong", err)
+	}
+	if err := c.SendBundle(flow, largeGroup(1024)); err != ErrTooLong {
+		t.Fatalf("SendBundle of a group of 1024 buckets returned %v, want ErrTooLong", err)
+	}
+	if err := c.Send(); err != nil {
+		t.Fatalf("barrier failed: %s", err)
+	}
+	// only the barrier of the last Send reached the switch
+	if received := s.messages(); len(received) != 1 || received[0][1] != typeBarrierRequest {
+		t.Errorf("switch received %x, want a single barrier", received)
+	}
+
+	// a bundle add wraps the message in 24 more bytes
+	for _, test := range []struct {
+		length  int
+		message error
+		bundle  error
+	}{
+		{65511, nil, nil},
+		{65512, nil, ErrTooLong},
+		{65535, nil, ErrTooLong},
+		{65536, ErrTooLong, ErrTooLong},
+	} {
+		flow := flowOfLength(test.length)
+		if err := CheckLength(flow); err != test.message {
+			t.Errorf("CheckLength of %d bytes returned %v, want %v", test.length, err, test.message)
+		}
+		if err := CheckBundleLength(flow); err != test.bundle {
+			t.Errorf("CheckBundleLength of %d bytes returned %v, want %v", test.length, err, test.bundle)
+		}
+	}
+	c, s = newFakeSwitch(t, bundleReplies(t, false))
+	defer c.Close()
+	if err := c.SendBundle(flowOfLength(65512)); err != ErrTooLong {
+		t.Fatalf("SendBundle of 65512 bytes returned %v, want ErrTooLong", err)
+	}
+	if received := s.messages(); len(received) != 0 {
+		t.Errorf("switch received %x, want nothing", received)
+	}
+	if err := c.SendBundle(flowOfLength(65511)); err != nil {
+		t.Fatalf("SendBundle of 65511 bytes failed: %s", err)
+	}
+	if add := s.messages()[1]; len(add) != maxLen {
+		t.Errorf("bundle add of %d bytes, want %d", len(add), maxLen)
+	}
+	if err := c.Send(flowOfLength(65535)); err != nil {
+		t.Errorf("Send of 65535 bytes failed: %s", err)
+	}
+}
+
+func TestSendError(t *testing.T) {
+	c, _ := newFakeSwitch(t, func(msgType uint8, xid uint32, body []byte) []*rawMessage {
+		if msgType == typeGroupMod {
+			return []*rawMessage{{msgType: typeError, xid: xid, body: decodeHex(t, "0006 0000")}}
+		}
+		return barrierReplies(msgType, xid, body)
+	})
+	defer c.Close()
+	err := c.Send(&GroupMod{Command: GroupAdd, Type: GroupTypeSelect, GroupID: 100})
+	if !IsError(err, ErrTypeGroupModFailed, ErrCodeGroupExists) {
+		t.Errorf("Send returned %v, want GROUP_MOD_FAILED code 0", err)
+	}
+}
+
+func TestDone(t *testing.T) {
+	c, s := newFakeSwitch(t, barrierReplies)
+	s.conn.Close()
+	<-c.Done()
+	if c.Err() == nil {
+		t.Errorf("no error after the switch closed the connection")
+	}
+	if err := c.Send(); err == nil {
+		t.Errorf("Send succeeded on a closed connection")
+	}
+}